@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+const commandUsage = `Usage: bitbucket-enforcer [flags] [command]
+
+Commands:
+  daemon                                 poll for and enforce new repositories (default)
+  enforce owner/repo [-policy name]      enforce a policy on a single repository
+  enforce-all [-once] [-force]           enforce policies on every repository
+  check owner/repo [-policy name]        report where a repository deviates from its policy
+  plan [-out file] [owner/repo]          show the changes enforcing would make
+  apply [-plan file] [owner/repo]        make the changes shown by plan, after confirming
+  validate [policy...]                   check policies for mistakes
+  schema [-out file]                     print the JSON Schema of policy files
+
+Flags:
+`
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage)
+		flag.PrintDefaults()
+	}
+}
+
+// parseCommand parses the flags of a command and returns the positional
+// arguments. Unlike flags.Parse, flags may also follow positional arguments.
+func parseCommand(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+
+	for {
+		flags.Parse(args)
+
+		if flags.NArg() == 0 {
+			return positional
+		}
+
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	return args[0]
+}
+
+// splitRepository splits an "owner/repo" argument
+func splitRepository(target string) (string, string, error) {
+	parts := strings.SplitN(target, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Repository must be given as owner/repo, not '%s'", target)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// getRepository fetches the repository given as "owner/repo"
+func getRepository(ctx context.Context, target string) (gobucket.Repository, error) {
+	owner, slug, err := splitRepository(target)
+	if err != nil {
+		return gobucket.Repository{}, err
+	}
+
+	repo, err := bbAPI.GetRepository(ctx, owner, slug)
+	if err != nil {
+		return repo, err
+	}
+	repo.FullName = fmt.Sprintf("%s/%s", owner, slug)
+
+	return repo, nil
+}
+
+// runDaemon implements the 'daemon' command, which is also the default
+func runDaemon(ctx context.Context, bbUsername string, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	parseCommand(flags, args)
+
+	if *listenAddr != "" {
+		if err := startWebhookReceiver(ctx, *listenAddr, os.Getenv("BITBUCKET_ENFORCER_WEBHOOK_SECRET")); err != nil {
+			return err
+		}
+	}
+
+	policies = openPolicyStore()
+
+	scanRepositories(ctx, bbUsername)
+
+	log.Info("Stopped")
+
+	return nil
+}
+
+// runEnforce implements the 'enforce owner/repo [-policy name]' command. The
+// policy is enforced even if it has been enforced before.
+func runEnforce(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("enforce", flag.ExitOnError)
+	policyname := flags.String("policy", "", "the policy to enforce instead of the one requested by the repository")
+	targets := parseCommand(flags, args)
+
+	if len(targets) != 1 {
+		return errors.New("enforce requires a single owner/repo argument")
+	}
+
+	ctx, cancel := repositoryContext(ctx)
+	defer cancel()
+
+	repo, err := getRepository(ctx, targets[0])
+	if err != nil {
+		return err
+	}
+
+	if *policyname == "" {
+		*policyname = repositoryPolicy(repo)
+	}
+
+	return enforceRepository(ctx, repo, *policyname)
+}
+
+/*
+Implements the 'enforce-all [-once] [-force]' command. Every repository that
+hasn't been enforced, or whose policy has changed, is enforced like the daemon
+does, but without waiting for the repository list to change. With -force,
+every repository is enforced again. Without -once, this is repeated every
+-pollinterval.
+*/
+func runEnforceAll(ctx context.Context, bbUsername string, args []string) error {
+	flags := flag.NewFlagSet("enforce-all", flag.ExitOnError)
+	once := flags.Bool("once", false, "enforce every repository once and exit")
+	force := flags.Bool("force", false, "enforce repositories that have already been enforced")
+	parseCommand(flags, args)
+
+	for {
+		failed, err := enforceAll(ctx, bbUsername, *force)
+
+		if ctx.Err() != nil {
+			return errors.New("Interrupted before all repositories were enforced")
+		}
+
+		if *once {
+			if err != nil {
+				return err
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("Could not enforce %d repositories", failed)
+			}
+
+			return nil
+		}
+
+		if err != nil {
+			log.Error("Error enforcing repositories", err)
+		}
+
+		select {
+		case <-time.After(*pollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+
+		refreshConfigRepository(ctx)
+	}
+}
+
+// enforceAll makes a single pass over all repositories and returns the number
+// of repositories that could not be enforced
+func enforceAll(ctx context.Context, bbUsername string, force bool) (int, error) {
+	repos, err := bbAPI.GetRepositories(ctx, bbUsername)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := forEachRepository(ctx, repos, func(ctx context.Context, repo gobucket.Repository) error {
+		if force && !strings.Contains(repo.Description, "-noenforce") {
+			return enforceRepository(ctx, repo, repositoryPolicy(repo))
+		}
+
+		return processRepository(ctx, repo)
+	})
+
+	return failed, nil
+}
+
+// runCheck implements the 'check owner/repo [-policy name]' command. It fails
+// if the repository deviates from the policy.
+func runCheck(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	policyname := flags.String("policy", "", "the policy to check instead of the one requested by the repository")
+	targets := parseCommand(flags, args)
+
+	if len(targets) != 1 {
+		return errors.New("check requires a single owner/repo argument")
+	}
+
+	ctx, cancel := repositoryContext(ctx)
+	defer cancel()
+
+	repo, err := getRepository(ctx, targets[0])
+	if err != nil {
+		return err
+	}
+
+	if *policyname == "" {
+		*policyname = repositoryPolicy(repo)
+	}
+
+	policy, err := repositoryPolicySettings(repo, *policyname)
+	if err != nil {
+		return err
+	}
+
+	owner, slug, _ := splitRepository(repo.FullName)
+
+	deviations, err := checkPolicy(ctx, owner, slug, policy)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deviations {
+		fmt.Println(redact(fmt.Sprintf("%s: %s", repo.FullName, d)))
+	}
+
+	if len(deviations) > 0 {
+		return fmt.Errorf("Repo '%s' deviates from policy '%s' in %d settings", repo.FullName, *policyname, len(deviations))
+	}
+
+	fmt.Printf("%s: matches policy '%s'\n", repo.FullName, *policyname)
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+/*
+configRepository is a git repository containing the policies, which is cloned
+to a local folder and checked out at a branch, tag or commit. -configdir is
+set to a folder in the checkout, so policies are read like any other policies.
+Git is run as a command, so it uses the usual SSH keys and credential helpers
+to access the repository.
+*/
+type configRepository struct {
+	url    string
+	ref    string // empty for the default branch
+	dir    string // the local clone
+	subdir string
+
+	mu     sync.Mutex
+	commit string // the commit that is checked out
+}
+
+// configRepo is set with -configrepo. Without it, policies are read from
+// -configdir as they are.
+var configRepo *configRepository
+
+// openConfigRepository clones the repository into dir, or updates an earlier
+// clone, and checks out ref
+func openConfigRepository(ctx context.Context, url string, ref string, dir string, subdir string) (*configRepository, error) {
+	r := &configRepository{url: url, ref: ref, dir: dir, subdir: subdir}
+
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := runGit(ctx, "", "clone", "--quiet", "--no-checkout", url, dir); err != nil {
+			return nil, fmt.Errorf("Error cloning config repository '%s': %s", url, err)
+		}
+	} else if _, err := r.git(ctx, "remote", "set-url", "origin", url); err != nil {
+		return nil, fmt.Errorf("Error using config repository clone '%s': %s", dir, err)
+	}
+
+	if _, err := r.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// policyDir returns the folder containing the policies
+func (r *configRepository) policyDir() string {
+	return filepath.Join(r.dir, r.subdir)
+}
+
+// currentCommit returns the SHA of the commit that is checked out
+func (r *configRepository) currentCommit() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.commit
+}
+
+/*
+Fetches the repository and checks out the commit that ref points to now, and
+reports whether it is another commit than before. Local changes in the clone
+are discarded. On errors, the checkout is left as it was.
+*/
+func (r *configRepository) refresh(ctx context.Context) (bool, error) {
+	if _, err := r.git(ctx, "fetch", "--quiet", "--force", "--prune", "--tags", "origin"); err != nil {
+		return false, fmt.Errorf("Error fetching config repository '%s': %s", r.url, err)
+	}
+
+	commit, err := r.resolve(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if commit == r.currentCommit() {
+		return false, nil
+	}
+
+	if _, err := r.git(ctx, "cat-file", "-e", commit+":"+filepath.ToSlash(r.subdir)); err != nil {
+		return false, fmt.Errorf("Config repository '%s' has no folder '%s' at commit %s", r.url, r.subdir, commit)
+	}
+
+	if _, err := r.git(ctx, "-c", "advice.detachedHead=false", "checkout", "--quiet", "--force", "--detach", commit); err != nil {
+		return false, fmt.Errorf("Error checking out commit %s of config repository '%s': %s", commit, r.url, err)
+	}
+
+	if _, err := r.git(ctx, "clean", "--quiet", "--force", "-d", "-x"); err != nil {
+		return false, fmt.Errorf("Error cleaning config repository clone '%s': %s", r.dir, err)
+	}
+
+	r.mu.Lock()
+	r.commit = commit
+	r.mu.Unlock()
+
+	return true, nil
+}
+
+// resolve returns the SHA of the commit that ref points to. A branch name
+// refers to the branch in the remote repository.
+func (r *configRepository) resolve(ctx context.Context) (string, error) {
+	candidates := []string{"origin/HEAD"}
+	if r.ref != "" {
+		candidates = []string{"origin/" + r.ref, r.ref}
+	}
+
+	for _, candidate := range candidates {
+		if commit, err := r.git(ctx, "rev-parse", "--quiet", "--verify", candidate+"^{commit}"); err == nil {
+			return commit, nil
+		}
+	}
+
+	return "", fmt.Errorf("Config repository '%s' has no branch, tag or commit '%s'", r.url, r.ref)
+}
+
+func (r *configRepository) git(ctx context.Context, args ...string) (string, error) {
+	return runGit(ctx, r.dir, args...)
+}
+
+// runGit runs git in dir and returns its output. Errors include what git
+// printed.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Never wait for a password
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", errors.New(message)
+		}
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// refreshConfigRepository updates the policies from -configrepo, if it is set,
+// and logs the new commit
+func refreshConfigRepository(ctx context.Context) {
+	if configRepo == nil {
+		return
+	}
+
+	changed, err := configRepo.refresh(ctx)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if changed {
+		log.Info(fmt.Sprintf("Config repository updated to commit %s", configRepo.currentCommit()))
+	}
+}
+
+// policyCommit returns the commit of the config repository that a policy was
+// read from, or "" if policies aren't read from a git repository
+func policyCommit(policyname string) string {
+	if policies != nil {
+		return policies.commit(policyname)
+	}
+
+	if configRepo != nil {
+		return configRepo.currentCommit()
+	}
+
+	return ""
+}
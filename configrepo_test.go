@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// commitPolicy writes a policy to the policies folder of a git repository and
+// commits it, and returns the SHA of the commit
+func commitPolicy(t *testing.T, repoDir string, filename string, content string) string {
+	ctx := context.Background()
+
+	if err := os.MkdirAll(filepath.Join(repoDir, "policies"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(repoDir, "policies", filename), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"add", "--all"},
+		{"-c", "user.name=Enforcer", "-c", "user.email=enforcer@example.com", "commit", "--quiet", "--message", "Update " + filename},
+	} {
+		if _, err := runGit(ctx, repoDir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit, err := runGit(ctx, repoDir, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return commit
+}
+
+func TestConfigRepositoryRef(t *testing.T) {
+	ctx := context.Background()
+	server := useTestServer(t, nil)
+	server.Bitbucket.AddRepository("acme", "api", "")
+
+	origin := t.TempDir()
+	if _, err := runGit(ctx, origin, "init", "--quiet"); err != nil {
+		t.Skipf("git is not available: %s", err)
+	}
+	if _, err := runGit(ctx, origin, "checkout", "--quiet", "-b", "production"); err != nil {
+		t.Fatal(err)
+	}
+	first := commitPolicy(t, origin, "default.json", `{"private": false}`)
+
+	repo, err := openConfigRepository(ctx, origin, "production", filepath.Join(t.TempDir(), "clone"), "policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.currentCommit() != first {
+		t.Fatalf("expected commit %s to be checked out, got %s", first, repo.currentCommit())
+	}
+
+	defer func(old *configRepository) { configRepo = old }(configRepo)
+	configRepo = repo
+	*configDir = repo.policyDir()
+	policies = openPolicyStore()
+
+	if failed, err := enforceAll(ctx, "acme", false); err != nil || failed != 0 {
+		t.Fatalf("enforceAll failed for %d repositories: %v", failed, err)
+	}
+	if record, _ := state.get("acme/api"); record.Commit != first {
+		t.Errorf("expected commit %s to be recorded, got '%s'", first, record.Commit)
+	}
+
+	// Nothing changes until the ref is advanced
+	if changed, err := repo.refresh(ctx); err != nil || changed {
+		t.Fatalf("expected no change, got %v, %v", changed, err)
+	}
+
+	second := commitPolicy(t, origin, "default.json", `{"private": false, "forks": "none"}`)
+
+	if changed, err := repo.refresh(ctx); err != nil || !changed {
+		t.Fatalf("expected the advanced ref to be checked out, got %v, %v", changed, err)
+	}
+	if repo.currentCommit() != second {
+		t.Fatalf("expected commit %s to be checked out, got %s", second, repo.currentCommit())
+	}
+
+	if changed := policies.reload(); len(changed) != 1 || changed[0] != "default" {
+		t.Fatalf("expected the default policy to be reloaded, got %v", changed)
+	}
+
+	if failed, err := enforceAll(ctx, "acme", false); err != nil || failed != 0 {
+		t.Fatalf("second enforceAll failed for %d repositories: %v", failed, err)
+	}
+	if forks := server.Bitbucket.Repository("acme", "api").Forks; forks != "none" {
+		t.Errorf("expected the policy of the new commit to be enforced, got forks '%s'", forks)
+	}
+	if record, _ := state.get("acme/api"); record.Commit != second {
+		t.Errorf("expected commit %s to be recorded, got '%s'", second, record.Commit)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+// deviation describes a single setting where a repository differs from its
+// policy
+type deviation struct {
+	Setting  string
+	Expected string
+	Actual   string
+}
+
+func (d deviation) String() string {
+	return fmt.Sprintf("%s: expected %s, found %s", d.Setting, d.Expected, d.Actual)
+}
+
+/*
+Compares the actual settings of a repository with a policy. Like
+applyPolicy, it only reports settings that are missing from or different in
+the repository, and only reports extra settings that aren't mentioned in the
+policy if the policy prunes.
+*/
+func checkPolicy(ctx context.Context, owner string, repo string, policy repositorySettings) ([]deviation, error) {
+	var deviations []deviation
+
+	repository, err := bbAPI.GetRepository(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Private != nil && repository.IsPrivate != *policy.Private {
+		deviations = append(deviations, deviation{"private", fmt.Sprint(*policy.Private), fmt.Sprint(repository.IsPrivate)})
+	}
+
+	if policy.Forks != "" && repository.Forks() != policy.Forks {
+		deviations = append(deviations, deviation{"forks", policy.Forks, repository.Forks()})
+	}
+
+	if policy.IssueTracker != nil && repository.HasIssues != *policy.IssueTracker {
+		deviations = append(deviations, deviation{"issuetracker", fmt.Sprint(*policy.IssueTracker), fmt.Sprint(repository.HasIssues)})
+	}
+
+	if len(policy.DeployKeys) > 0 || policy.Prune {
+		keyDeviations, err := checkDeployKeys(ctx, owner, repo, policy.DeployKeys, policy.pruning())
+		if err != nil {
+			return nil, err
+		}
+		deviations = append(deviations, keyDeviations...)
+	}
+
+	if len(policy.PostHooks) > 0 || policy.Prune {
+		hookList, err := bbAPI.GetServices(ctx, owner, repo)
+		if err != nil {
+			return nil, err
+		}
+
+		var currentHooks bbServices = hookList
+		for _, url := range policy.PostHooks {
+			if !currentHooks.hasPOSTHook(url) {
+				deviations = append(deviations, deviation{"posthooks", url, "missing"})
+			}
+		}
+
+		if policy.Prune {
+			for _, hook := range extraPOSTHooks(hookList, policy.PostHooks, policy.Keep.PostHooks) {
+				deviations = append(deviations, deviation{"posthooks", "no hook", hookURL(hook)})
+			}
+		}
+	}
+
+	branchDeviations, err := checkBranchManagement(ctx, owner, repo, policy.BranchManagement, policy.pruning())
+	if err != nil {
+		return nil, err
+	}
+	deviations = append(deviations, branchDeviations...)
+
+	accessDeviations, err := checkAccessManagement(ctx, owner, repo, policy.AccessManagement, policy.pruning())
+	if err != nil {
+		return nil, err
+	}
+	deviations = append(deviations, accessDeviations...)
+
+	return deviations, nil
+}
+
+func checkDeployKeys(ctx context.Context, owner string, repo string, keys publicKeyList, prune *pruneAllowlist) ([]deviation, error) {
+	var deviations []deviation
+
+	currkeys, err := bbAPI.GetDeployKeys(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		found := "missing"
+
+		for _, current := range currkeys {
+			if current.Key == key.Key && current.Label == key.Name {
+				found = ""
+				break
+			} else if current.Key == key.Key {
+				found = fmt.Sprintf("named '%s'", current.Label)
+			}
+		}
+
+		if found != "" {
+			deviations = append(deviations, deviation{"deploykeys", fmt.Sprintf("'%s'", key.Name), found})
+		}
+	}
+
+	if prune != nil {
+		for _, key := range extraDeployKeys(currkeys, keys, prune.DeployKeys) {
+			deviations = append(deviations, deviation{"deploykeys", "no key", fmt.Sprintf("'%s'", key.Label)})
+		}
+	}
+
+	return deviations, nil
+}
+
+func checkBranchManagement(ctx context.Context, owner string, repo string, policies branchManagement, prune *pruneAllowlist) ([]deviation, error) {
+	var deviations []deviation
+
+	if len(policies.PreventDelete) == 0 && len(policies.PreventRebase) == 0 && len(policies.AllowPushes) == 0 && prune == nil {
+		return nil, nil
+	}
+
+	restrictions, err := bbAPI.GetBranchRestrictions(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, branch := range policies.PreventDelete {
+		if _, ok := findBranchRestriction(restrictions, "delete", branch); !ok {
+			deviations = append(deviations, deviation{"branchmanagement.preventdelete", branch, "missing"})
+		}
+	}
+
+	for _, branch := range policies.PreventRebase {
+		if _, ok := findBranchRestriction(restrictions, "force", branch); !ok {
+			deviations = append(deviations, deviation{"branchmanagement.preventrebase", branch, "missing"})
+		}
+	}
+
+	for branch, permissions := range policies.AllowPushes {
+		setting := fmt.Sprintf("branchmanagement.allowpushes.%s", branch)
+
+		restriction, ok := findBranchRestriction(restrictions, "push", branch)
+		if !ok {
+			deviations = append(deviations, deviation{setting, "push restriction", "missing"})
+			continue
+		}
+
+		deviations = append(deviations, memberDeviations(setting+".users", permissions.Users, restriction.Users, prune != nil)...)
+		deviations = append(deviations, memberDeviations(setting+".groups", permissions.Groups, restriction.Groups, prune != nil)...)
+	}
+
+	if prune != nil {
+		for _, restriction := range extraBranchRestrictions(restrictions, policies, prune.Branches) {
+			deviations = append(deviations, deviation{fmt.Sprintf("branchmanagement.%s", restriction.Kind), "no restriction", restriction.Pattern})
+		}
+	}
+
+	return deviations, nil
+}
+
+func checkAccessManagement(ctx context.Context, owner string, repo string, policies accessManagement, prune *pruneAllowlist) ([]deviation, error) {
+	var deviations []deviation
+
+	if len(policies.Users) > 0 || prune != nil {
+		privileges, err := bbAPI.GetUserPrivileges(ctx, owner, repo)
+		if err != nil {
+			return nil, err
+		}
+		deviations = append(deviations, comparePrivileges("accessmanagement.users", policies.Users, privileges)...)
+
+		if prune != nil {
+			keep, err := keptUsers(ctx, prune)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, username := range extraPrivileges(privileges, policies.Users, keep) {
+				deviations = append(deviations, deviation{fmt.Sprintf("accessmanagement.users.%s", username), "none", privileges[username]})
+			}
+		}
+	}
+
+	if len(policies.Groups) > 0 || prune != nil {
+		privileges, err := bbAPI.GetGroupPrivileges(ctx, owner, repo)
+		if err != nil {
+			return nil, err
+		}
+		deviations = append(deviations, comparePrivileges("accessmanagement.groups", policies.Groups, privileges)...)
+
+		if prune != nil {
+			for _, groupname := range extraPrivileges(privileges, policies.Groups, prune.Groups) {
+				deviations = append(deviations, deviation{fmt.Sprintf("accessmanagement.groups.%s", groupname), "none", privileges[groupname]})
+			}
+		}
+	}
+
+	return deviations, nil
+}
+
+func comparePrivileges(setting string, expected map[string]string, actual map[string]string) []deviation {
+	var deviations []deviation
+
+	for _, entity := range sortedKeys(expected) {
+		privilege, ok := actual[entity]
+		if !ok {
+			privilege = "none"
+		}
+
+		if privilege != expected[entity] {
+			deviations = append(deviations, deviation{fmt.Sprintf("%s.%s", setting, entity), expected[entity], privilege})
+		}
+	}
+
+	return deviations
+}
+
+// missingEntries returns the entries of expected that are not in actual
+// memberDeviations reports the users or groups missing from a push
+// restriction, and when pruning, the ones that aren't in the policy
+func memberDeviations(setting string, expected []string, actual []string, prune bool) []deviation {
+	var deviations []deviation
+
+	missing, extra := memberChanges(expected, actual, prune)
+	if len(missing) > 0 {
+		deviations = append(deviations, deviation{setting, strings.Join(missing, ", "), "missing"})
+	}
+	if len(extra) > 0 {
+		deviations = append(deviations, deviation{setting, "none", strings.Join(extra, ", ")})
+	}
+
+	return deviations
+}
+
+func missingEntries(expected []string, actual []string) []string {
+	var missing []string
+
+	for _, needle := range expected {
+		if !contains(actual, needle) {
+			missing = append(missing, needle)
+		}
+	}
+
+	return missing
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+/*
+Checks every repository that has already been enforced against its policy and
+logs all deviations. If -repair is given, the policy is enforced again on
+repositories that have drifted.
+*/
+func auditRepositories(ctx context.Context, bbUsername string) {
+	repos, err := bbAPI.GetRepositories(ctx, bbUsername)
+	if err != nil {
+		log.Error("Error getting repository list", err)
+		return
+	}
+
+	forEachRepository(ctx, repos, auditRepository)
+}
+
+// auditRepository checks a single enforced repository for drift
+func auditRepository(ctx context.Context, repo gobucket.Repository) error {
+	if !isEnforced(repo) {
+		return nil
+	}
+
+	policyname := repositoryPolicy(repo)
+	policy, err := repositoryPolicySettings(repo, policyname)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error parsing policy '%s' for repo '%s': ", policyname, repo.FullName), err)
+		return err
+	}
+
+	parts := strings.Split(repo.FullName, "/")
+
+	deviations, err := checkPolicy(ctx, parts[0], parts[1], policy)
+	if err != nil {
+		log.Warning(fmt.Sprintf("Could not audit repo '%s' (%s)", repo.FullName, describeError(err)))
+		return err
+	}
+
+	if len(deviations) == 0 {
+		if *verbose {
+			log.Info(fmt.Sprintf("Repo '%s' matches policy '%s'", repo.FullName, policyname))
+		}
+		return nil
+	}
+
+	for _, d := range deviations {
+		log.Warning(redact(fmt.Sprintf("Repo '%s' deviates from policy '%s': %s", repo.FullName, policyname, d)))
+	}
+
+	if *repair {
+		return enforceRepository(ctx, repo, policyname)
+	}
+
+	return nil
+}
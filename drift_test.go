@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRepairPushRestrictionMembers(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{`{"branchmanagement": {"allowpushes": {"master": {"users": ["bob"]}}}}`, []string{"alice", "bob"}},
+		{`{"prune": true, "branchmanagement": {"allowpushes": {"master": {"users": ["bob"]}}}}`, []string{"bob"}},
+	}
+
+	defer func(old bool) { *repair = old }(*repair)
+	*repair = true
+
+	for _, test := range tests {
+		server := useTestServer(t, map[string]string{"default.json": test.policy})
+
+		ctx := context.Background()
+		bb := server.Bitbucket
+		bb.AddRepository("acme", "api", "")
+		bb.AddBranchRestriction(ctx, "acme", "api", "push", "master", []string{"alice"}, nil)
+
+		repo, err := bbAPI.GetRepository(ctx, "acme", "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recordState(repo.FullName, "", "default", "", "", nil)
+
+		policy, err := repositoryPolicySettings(repo, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if deviations, err := checkPolicy(ctx, "acme", "api", policy); err != nil || len(deviations) == 0 {
+			t.Fatalf("%s: expected the push restriction to deviate, got %v, %v", test.policy, deviations, err)
+		}
+
+		if err := auditRepository(ctx, repo); err != nil {
+			t.Fatal(err)
+		}
+
+		users := bb.Repository("acme", "api").Restrictions[0].Users
+		if !reflect.DeepEqual(users, test.expected) {
+			t.Errorf("%s: expected users %v after repairing, got %v", test.policy, test.expected, users)
+		}
+
+		if deviations, err := checkPolicy(ctx, "acme", "api", policy); err != nil || len(deviations) != 0 {
+			t.Errorf("%s: expected no deviations after repairing, got %v, %v", test.policy, deviations, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+// dryRunClient passes read-only calls through to the wrapped client, but only
+// logs the calls that would modify a repository
+type dryRunClient struct {
+	gobucket.Client
+}
+
+func logDryRun(method string, owner string, repo string, payload interface{}) {
+	payloadJSON, _ := json.Marshal(payload)
+	log.Info(redact(fmt.Sprintf("Dry run: %s on '%s/%s' with %s", method, owner, repo, payloadJSON)))
+}
+
+func (c dryRunClient) AddBranchRestriction(ctx context.Context, owner string, repo string, kind string, branchpattern string, users []string, groups []string) error {
+	logDryRun("AddBranchRestriction", owner, repo, map[string]interface{}{"kind": kind, "pattern": branchpattern, "users": users, "groups": groups})
+	return nil
+}
+
+func (c dryRunClient) UpdateBranchRestriction(ctx context.Context, owner string, repo string, restriction gobucket.BranchRestriction) error {
+	logDryRun("UpdateBranchRestriction", owner, repo, map[string]interface{}{"id": restriction.ID, "users": restriction.Users, "groups": restriction.Groups})
+	return nil
+}
+
+func (c dryRunClient) DeleteBranchRestriction(ctx context.Context, owner string, repo string, restrictionID int) error {
+	logDryRun("DeleteBranchRestriction", owner, repo, map[string]int{"id": restrictionID})
+	return nil
+}
+
+func (c dryRunClient) AddUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string, privilege string) error {
+	logDryRun("AddUserPrivilege", owner, repo, map[string]string{"user": privilegeUser, "permission": privilege})
+	return nil
+}
+
+func (c dryRunClient) AddGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string, privilege string) error {
+	logDryRun("AddGroupPrivilege", owner, repo, map[string]string{"group": privilegeGroup, "permission": privilege})
+	return nil
+}
+
+func (c dryRunClient) DeleteUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string) error {
+	logDryRun("DeleteUserPrivilege", owner, repo, map[string]string{"user": privilegeUser})
+	return nil
+}
+
+func (c dryRunClient) DeleteGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string) error {
+	logDryRun("DeleteGroupPrivilege", owner, repo, map[string]string{"group": privilegeGroup})
+	return nil
+}
+
+func (c dryRunClient) AddService(ctx context.Context, owner string, repository string, servicetype string, parameters map[string]string) error {
+	logDryRun("AddService", owner, repository, map[string]interface{}{"type": servicetype, "parameters": parameters})
+	return nil
+}
+
+func (c dryRunClient) DeleteService(ctx context.Context, owner string, repository string, serviceUUID string) error {
+	logDryRun("DeleteService", owner, repository, map[string]string{"uuid": serviceUUID})
+	return nil
+}
+
+func (c dryRunClient) AddDeployKey(ctx context.Context, owner string, repository string, name string, key string) error {
+	logDryRun("AddDeployKey", owner, repository, map[string]string{"label": name, "key": key})
+	return nil
+}
+
+func (c dryRunClient) DeleteDeployKey(ctx context.Context, owner string, repository string, keyID int) error {
+	logDryRun("DeleteDeployKey", owner, repository, map[string]int{"id": keyID})
+	return nil
+}
+
+func (c dryRunClient) SetPrivacy(ctx context.Context, owner string, repository string, isPrivate bool) error {
+	logDryRun("SetPrivacy", owner, repository, map[string]bool{"is_private": isPrivate})
+	return nil
+}
+
+func (c dryRunClient) SetIssueTracker(ctx context.Context, owner string, repository string, issueTracker bool) error {
+	logDryRun("SetIssueTracker", owner, repository, map[string]bool{"has_issues": issueTracker})
+	return nil
+}
+
+func (c dryRunClient) SetDescription(ctx context.Context, owner string, repository string, description string) error {
+	logDryRun("SetDescription", owner, repository, map[string]string{"description": description})
+	return nil
+}
+
+func (c dryRunClient) SetForks(ctx context.Context, owner string, repository string, forks string) error {
+	logDryRun("SetForks", owner, repository, map[string]string{"forks": forks})
+	return nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	dotenv "godotenv"
@@ -19,18 +23,21 @@ import (
 type branchManagement struct {
 	PreventDelete []string
 	PreventRebase []string
-	AllowPushes   map[string]struct {
-		Groups []string
-		Users  []string
-	}
+	AllowPushes   map[string]pushPermissions
+}
+
+type pushPermissions struct {
+	Groups []string
+	Users  []string
 }
 
 type accessManagement struct {
-	Users  map[string]string // usernames => permissions
+	Users  map[string]string // account IDs => permissions
 	Groups map[string]string // groupnames => permissions
 }
 
 type repositorySettings struct {
+	Extends          []string `json:",omitempty"` // policies whose settings are included
 	Private          *bool
 	Forks            string
 	IssueTracker     *bool
@@ -38,6 +45,18 @@ type repositorySettings struct {
 	PostHooks        []string
 	BranchManagement branchManagement
 	AccessManagement accessManagement
+	Prune            bool
+	Keep             pruneAllowlist
+}
+
+// pruning returns the settings to keep when pruning, or nil if the policy
+// doesn't remove settings that aren't in it
+func (s repositorySettings) pruning() *pruneAllowlist {
+	if !s.Prune {
+		return nil
+	}
+
+	return &s.Keep
 }
 
 type publicKey struct {
@@ -58,9 +77,29 @@ const (
 
 const sleepTime = 5 * time.Second
 
-var configDir = flag.String("configdir", "configs", "the folder containing repository configrations")
+var configDir = flag.String("configdir", "configs", "the folder containing repository configrations, within the -configrepo repository if it is set")
+var configRepoURL = flag.String("configrepo", "", "a git repository containing the policies, e.g. 'git@bitbucket.org:acme/policies.git'")
+var configRef = flag.String("configref", "", "the branch, tag or commit of -configrepo to use (empty for the default branch)")
+var configClone = flag.String("configclone", "enforcer-config", "the folder -configrepo is cloned to")
+var configRefresh = flag.Duration("configrefresh", time.Minute, "how often the daemon fetches -configrepo")
 var verbose = flag.Bool("v", false, "print more output")
-var bbAPI *gobucket.APIClient
+var pollInterval = flag.Duration("pollinterval", sleepTime, "how often to check for new repositories")
+var reloadInterval = flag.Duration("reloadinterval", 10*time.Second, "how often the daemon checks the config folder for changed policies")
+var listenAddr = flag.String("listen", "", "address to receive Bitbucket webhooks on, e.g. ':8080' (empty disables the webhook receiver)")
+var auditInterval = flag.Duration("auditinterval", 0, "how often to check enforced repositories for drift (0 disables auditing)")
+var workers = flag.Int("workers", 4, "the number of repositories to enforce in parallel")
+var rateLimit = flag.Int("ratelimit", 0, "the maximum number of API requests per hour (0 for no limit)")
+var maxRetries = flag.Int("maxretries", 5, "how many times to retry rate limited or failed API requests")
+var requestTimeout = flag.Duration("requesttimeout", gobucket.DefaultTimeout, "the time limit for a single API request (0 for no limit)")
+var repoTimeout = flag.Duration("repotimeout", 10*time.Minute, "the time limit for enforcing a single repository (0 for no limit)")
+var shutdownTimeout = flag.Duration("shutdowntimeout", 30*time.Second, "how long to let enforcements in progress finish when shutting down")
+var selectorFile = flag.String("selectors", "", "a file with rules selecting the policy of each repository")
+var repair = flag.Bool("repair", false, "re-enforce policies on repositories that have drifted")
+var dryRun = flag.Bool("dry-run", false, "log changes to repositories instead of making them")
+var stateFile = flag.String("statefile", "enforcer-state.json", "the file recording which repositories have been enforced")
+var descriptionTag = flag.Bool("descriptiontag", false, "also add '-enforced' to the description of enforced repositories")
+var bbAPI gobucket.Client
+var state *stateStore
 
 func main() {
 	log.SetPrefix("bitbucket-enforcer")
@@ -75,146 +114,364 @@ func main() {
 	bbUsername := os.Getenv("BITBUCKET_ENFORCER_USERNAME")
 	bbKey := os.Getenv("BITBUCKET_ENFORCER_API_KEY")
 
-	bbAPI = gobucket.New(bbUsername, bbKey)
+	client := gobucket.New(bbUsername, bbKey)
+	if bbURL := os.Getenv("BITBUCKET_ENFORCER_API_URL"); bbURL != "" {
+		client.BaseURL = bbURL
+	}
+	client.SetRateLimit(*rateLimit, time.Hour)
+	client.MaxRetries = *maxRetries
+	client.Timeout = *requestTimeout
+	client.OnRetry = func(method string, url string, attempt int, delay time.Duration, reason string) {
+		log.Notice(fmt.Sprintf("Retrying %s %s in %s, attempt %d of %d (%s, %d retries in total)", method, url, delay, attempt, *maxRetries, reason, client.RetryCount()))
+	}
+	bbAPI = client
 
-	scanRepositories(bbUsername)
-}
+	if *dryRun {
+		log.Notice("Dry run, repositories will not be changed")
+		bbAPI = dryRunClient{client}
+	}
 
-func scanRepositories(bbUsername string) {
-	var enforcementMatcher = regexp.MustCompile(`-enforce(?:=([a-zA-Z0-9]+))?`)
+	if state, err = openStateStore(*stateFile); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
 
-	var lastEtag string
-	var changed bool
+	if *selectorFile != "" {
+		if selector, err = loadSelector(*selectorFile); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
 
-	for _ = range time.Tick(sleepTime) {
-		var err error
-		if changed, lastEtag, err = bbAPI.RepositoriesChanged(bbUsername, lastEtag); err != nil {
-			log.Error(fmt.Sprintf("Error determining if repository list has changed (%s)", err))
-			continue
+	ctx, cancel := shutdownContext()
+	defer cancel()
+
+	if *configRepoURL != "" {
+		if configRepo, err = openConfigRepository(ctx, *configRepoURL, *configRef, *configClone, *configDir); err != nil {
+			log.Error(err)
+			cancel()
+			os.Exit(1)
 		}
 
-		if !changed {
-			if *verbose {
-				log.Info("No repository changes, sleeping.")
-			}
-			continue
+		log.Info(fmt.Sprintf("Using policies from commit %s of '%s'", configRepo.currentCommit(), *configRepoURL))
+		*configDir = configRepo.policyDir()
+	}
+
+	var args []string
+	if flag.NArg() > 0 {
+		args = flag.Args()[1:]
+	}
+
+	switch flag.Arg(0) {
+	case "daemon", "":
+		err = runDaemon(ctx, bbUsername, args)
+	case "enforce":
+		err = runEnforce(ctx, args)
+	case "enforce-all":
+		err = runEnforceAll(ctx, bbUsername, args)
+	case "check":
+		err = runCheck(ctx, args)
+	case "plan":
+		err = runPlan(ctx, bbUsername, args)
+	case "validate":
+		err = runValidate(args)
+	case "schema":
+		err = runSchema(args)
+	case "apply":
+		err = runApply(ctx, bbUsername, args)
+	default:
+		flag.Usage()
+		err = fmt.Errorf("Unknown command '%s'", flag.Arg(0))
+	}
+
+	if err != nil {
+		log.Error(err)
+		cancel()
+		os.Exit(1)
+	}
+}
+
+/*
+Returns a context that is cancelled on SIGINT or SIGTERM. Work in progress
+gets -shutdowntimeout to finish after that. A second signal stops the process
+immediately, which is safe as the state file is never partially written.
+*/
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Notice(fmt.Sprintf("Received %s, shutting down. Signal again to stop immediately.", sig))
+			signal.Stop(signals)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(signals)
 		}
+	}()
 
-		log.Info("Repository list changed")
+	return ctx, cancel
+}
 
-		repos, err := bbAPI.GetRepositories(bbUsername)
+var enforcementMatcher = regexp.MustCompile(`-enforce(?:=([a-zA-Z0-9]+))?`)
 
-		if err != nil {
-			log.Error("Error getting repository list", err)
-			continue
+/*
+Returns the name of the policy of a repository. A policy requested in the
+description with '-enforce=name' takes precedence. Otherwise the policy is
+picked by the -selectors rules, or is "default" if there are none.
+*/
+func repositoryPolicy(repo gobucket.Repository) string {
+	matches := enforcementMatcher.FindStringSubmatch(repo.Description)
+
+	if len(matches) > 0 && matches[1] != "" {
+		return matches[1]
+	}
+
+	if selector != nil {
+		return selector.policy(repo)
+	}
+
+	return "default"
+}
+
+func scanRepositories(ctx context.Context, bbUsername string) {
+	var lastEtag string
+
+	pollTicker := time.NewTicker(*pollInterval)
+	defer pollTicker.Stop()
+
+	reloadTicker := time.NewTicker(*reloadInterval)
+	defer reloadTicker.Stop()
+
+	var refreshTicker <-chan time.Time
+	if configRepo != nil {
+		ticker := time.NewTicker(*configRefresh)
+		defer ticker.Stop()
+		refreshTicker = ticker.C
+	}
+
+	reload := func() {
+		if changed := policies.reload(); len(changed) > 0 {
+			log.Info(fmt.Sprintf("Policies changed: %s", strings.Join(changed, ", ")))
+			// Forget the ETag to re-check every repository against the new policies
+			lastEtag = ""
 		}
+	}
 
-		for _, repo := range repos {
-			if strings.Contains(repo.Description, "-noenforce") {
-				if *verbose {
-					log.Info(fmt.Sprintf("Skipping <%s> because of '-noenforce'\n", repo.FullName))
-				}
-				continue
-			}
+	var auditTicker <-chan time.Time
+	if *auditInterval > 0 {
+		ticker := time.NewTicker(*auditInterval)
+		defer ticker.Stop()
+		auditTicker = ticker.C
+	}
 
-			if strings.Contains(repo.Description, "-enforced") {
-				if *verbose {
-					log.Info(fmt.Sprintf("Skipping <%s> because of '-enforced'\n", repo.FullName))
-				}
-				continue
-			}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pollTicker.C:
+			lastEtag = pollRepositories(ctx, bbUsername, lastEtag)
+		case <-reloadTicker.C:
+			reload()
+		case <-refreshTicker:
+			refreshConfigRepository(ctx)
+			reload()
+		case repo := <-webhookRepositories:
+			forEachRepository(ctx, []gobucket.Repository{repo}, processRepository)
+		case <-auditTicker:
+			log.Info("Auditing enforced repositories")
+			auditRepositories(ctx, bbUsername)
+		}
+	}
+}
 
-			matches := enforcementMatcher.FindStringSubmatch(repo.Description)
+// pollRepositories enforces policies on new repositories if the repository
+// list has changed since lastEtag. It returns the current ETag.
+func pollRepositories(ctx context.Context, bbUsername string, lastEtag string) string {
+	changed, etag, err := bbAPI.RepositoriesChanged(ctx, bbUsername, lastEtag)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error determining if repository list has changed (%s)", describeError(err)))
+		return lastEtag
+	}
 
-			enforcementPolicy := "default"
-			if len(matches) > 0 {
-				enforcementPolicy = matches[1]
-			}
+	if !changed {
+		if *verbose {
+			log.Info("No repository changes, sleeping.")
+		}
+		return etag
+	}
 
-			log.Info(fmt.Sprintf("Enforcing repo '%s' with policy '%s'", repo.FullName, enforcementPolicy))
+	log.Info("Repository list changed")
 
-			parts := strings.Split(repo.FullName, "/")
+	repos, err := bbAPI.GetRepositories(ctx, bbUsername)
 
-			err := enforcePolicy(parts[0], parts[1], enforcementPolicy)
+	if err != nil {
+		log.Error(fmt.Sprintf("Error getting repository list (%s)", describeError(err)))
+		return lastEtag
+	}
 
-			if err != nil {
-				log.Warning(fmt.Sprintf("Could not enforce policy '%s' on repo '%s'. Will be processed again next cycle. (%s)", enforcementPolicy, repo.FullName, err))
-			} else {
-				newDescription := strings.TrimSpace(fmt.Sprintf("%s\n\n-enforced", repo.Description))
+	forEachRepository(ctx, repos, processRepository)
 
-				if err := bbAPI.SetDescription(parts[0], parts[1], newDescription); err != nil {
-					log.Warning("Could not set description on repo '%s'. Will be processed again next cycle.", repo.FullName)
-				}
+	return etag
+}
+
+// processRepository enforces the policy of a repository, unless it opts out
+// or the policy has already been enforced
+func processRepository(ctx context.Context, repo gobucket.Repository) error {
+	if strings.Contains(repo.Description, "-noenforce") {
+		if *verbose {
+			log.Info(fmt.Sprintf("Skipping <%s> because of '-noenforce'\n", repo.FullName))
+		}
+		return nil
+	}
+
+	enforcementPolicy := repositoryPolicy(repo)
+
+	if isEnforced(repo) {
+		if !policyChanged(repo, enforcementPolicy) {
+			if *verbose {
+				log.Info(fmt.Sprintf("Skipping <%s> because it is already enforced\n", repo.FullName))
 			}
+			return nil
 		}
+
+		log.Info(fmt.Sprintf("Policy of repo '%s' has changed since it was enforced", repo.FullName))
 	}
+
+	return enforceRepository(ctx, repo, enforcementPolicy)
 }
 
-func enforcePolicy(owner string, repo string, policyname string) error {
-	policy, err := parseConfig(policyname)
+// enforceRepository enforces a policy on a repository and records the result
+func enforceRepository(ctx context.Context, repo gobucket.Repository, policyname string) error {
+	log.Info(fmt.Sprintf("Enforcing repo '%s' with policy '%s'", repo.FullName, policyname))
 
+	policy, err := repositoryPolicySettings(repo, policyname)
 	if err != nil {
-		log.Error(fmt.Sprintf("Error parsing parsing policy '%s': ", policyname), err)
+		log.Error(fmt.Sprintf("Error parsing policy '%s' for repo '%s': ", policyname, repo.FullName), err)
 		return err
 	}
 
+	parts := strings.Split(repo.FullName, "/")
+
+	err = applyPolicy(ctx, parts[0], parts[1], policy)
+	if err != nil {
+		log.Warning(redact(fmt.Sprintf("Could not enforce policy '%s' on repo '%s'. Will be processed again next cycle. (%s)", policyname, repo.FullName, describeError(err))))
+	}
+
+	recordEnforcement(ctx, repo, policyname, policy, err)
+
+	return err
+}
+
+/*
+Adds a hint about the likely cause to errors returned by the BitBucket API, so
+the log tells the operator what to do about them.
+*/
+func describeError(err error) string {
+	switch {
+	case gobucket.IsPermissionDenied(err):
+		return fmt.Sprintf("%s; check the credentials and that the account has admin access", err)
+	case gobucket.IsRateLimited(err):
+		return fmt.Sprintf("%s; rate limited by BitBucket, consider lowering -ratelimit", err)
+	case gobucket.IsNotFound(err):
+		return fmt.Sprintf("%s; the repository, user or group doesn't exist", err)
+	}
+
+	return err.Error()
+}
+
+func applyPolicy(ctx context.Context, owner string, repo string, policy repositorySettings) error {
 	if policy.Forks != "" {
-		if err := bbAPI.SetForks(owner, repo, policy.Forks); err != nil {
-			log.Warning("Error fork policy: ", err)
+		if err := bbAPI.SetForks(ctx, owner, repo, policy.Forks); err != nil {
+			log.Warning(fmt.Sprintf("Error setting fork policy on '%s/%s': ", owner, repo), err)
 			return err
 		}
 	}
 
 	if policy.Private != nil {
-		if err := bbAPI.SetPrivacy(owner, repo, *policy.Private); err != nil {
-			log.Warning("Error setting privacy: ", err)
+		if err := bbAPI.SetPrivacy(ctx, owner, repo, *policy.Private); err != nil {
+			log.Warning(fmt.Sprintf("Error setting privacy on '%s/%s': ", owner, repo), err)
 			return err
 		}
 	}
 
-	if len(policy.DeployKeys) > 0 {
-		if err := enforceDeployKeys(owner, repo, policy.DeployKeys); err != nil {
-			log.Warning("Error setting deploy keys: ", err)
+	if len(policy.DeployKeys) > 0 || policy.Prune {
+		if err := enforceDeployKeys(ctx, owner, repo, policy.DeployKeys, policy.pruning()); err != nil {
+			log.Warning(fmt.Sprintf("Error setting deploy keys on '%s/%s': ", owner, repo), err)
 			return err
 		}
 	}
 
-	if len(policy.PostHooks) > 0 {
-		if err := enforcePOSTHooks(owner, repo, policy.PostHooks); err != nil {
-			log.Warning("Error setting POST hooks: ", err)
+	if len(policy.PostHooks) > 0 || policy.Prune {
+		if err := enforcePOSTHooks(ctx, owner, repo, policy.PostHooks, policy.pruning()); err != nil {
+			log.Warning(fmt.Sprintf("Error setting POST hooks on '%s/%s': ", owner, repo), err)
 			return err
 		}
 	}
 
 	if policy.IssueTracker != nil {
-		if err := bbAPI.SetIssueTracker(owner, repo, *policy.IssueTracker); err != nil {
-			log.Warning("Error setting issue tracker: ", err)
+		if err := bbAPI.SetIssueTracker(ctx, owner, repo, *policy.IssueTracker); err != nil {
+			log.Warning(fmt.Sprintf("Error setting issue tracker on '%s/%s': ", owner, repo), err)
 			return err
 		}
 	}
 
-	if err := enforceBranchManagement(owner, repo, policy.BranchManagement); err != nil {
-		log.Warning("Error setting branch policies: ", err)
+	if err := enforceBranchManagement(ctx, owner, repo, policy.BranchManagement, policy.pruning()); err != nil {
+		log.Warning(fmt.Sprintf("Error setting branch policies on '%s/%s': ", owner, repo), err)
 		return err
 	}
 
-	if err := enforceAccessManagement(owner, repo, policy.AccessManagement); err != nil {
-		log.Warning("Error setting access policies: ", err)
+	if err := enforceAccessManagement(ctx, owner, repo, policy.AccessManagement, policy.pruning()); err != nil {
+		log.Warning(fmt.Sprintf("Error setting access policies on '%s/%s': ", owner, repo), err)
 		return err
 	}
 
 	return nil
 }
 
-func enforceAccessManagement(owner string, repo string, policies accessManagement) error {
+func enforceAccessManagement(ctx context.Context, owner string, repo string, policies accessManagement, prune *pruneAllowlist) error {
 	for username, privilege := range policies.Users {
-		if err := bbAPI.AddUserPrivilege(owner, repo, username, privilege); err != nil {
+		if err := bbAPI.AddUserPrivilege(ctx, owner, repo, username, privilege); err != nil {
 			return err
 		}
 	}
 
 	for groupname, privilege := range policies.Groups {
-		if err := bbAPI.AddGroupPrivilege(owner, repo, groupname, privilege); err != nil {
+		if err := bbAPI.AddGroupPrivilege(ctx, owner, repo, groupname, privilege); err != nil {
+			return err
+		}
+	}
+
+	if prune == nil {
+		return nil
+	}
+
+	userPrivileges, err := bbAPI.GetUserPrivileges(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+
+	keep, err := keptUsers(ctx, prune)
+	if err != nil {
+		return err
+	}
+
+	for _, username := range extraPrivileges(userPrivileges, policies.Users, keep) {
+		if err := ignoreNotFound(bbAPI.DeleteUserPrivilege(ctx, owner, repo, username)); err != nil {
+			return err
+		}
+	}
+
+	groupPrivileges, err := bbAPI.GetGroupPrivileges(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+
+	for _, groupname := range extraPrivileges(groupPrivileges, policies.Groups, prune.Groups) {
+		if err := ignoreNotFound(bbAPI.DeleteGroupPrivilege(ctx, owner, repo, groupname)); err != nil {
 			return err
 		}
 	}
@@ -222,21 +479,53 @@ func enforceAccessManagement(owner string, repo string, policies accessManagemen
 	return nil
 }
 
-func enforceBranchManagement(owner string, repo string, policies branchManagement) error {
+func enforceBranchManagement(ctx context.Context, owner string, repo string, policies branchManagement, prune *pruneAllowlist) error {
 	for _, branch := range policies.PreventDelete {
-		if err := bbAPI.AddBranchRestriction(owner, repo, "delete", branch, nil, nil); err != nil {
+		if err := bbAPI.AddBranchRestriction(ctx, owner, repo, "delete", branch, nil, nil); err != nil {
 			return err
 		}
 	}
 
 	for _, branch := range policies.PreventRebase {
-		if err := bbAPI.AddBranchRestriction(owner, repo, "force", branch, nil, nil); err != nil {
+		if err := bbAPI.AddBranchRestriction(ctx, owner, repo, "force", branch, nil, nil); err != nil {
 			return err
 		}
 	}
 
+	if len(policies.AllowPushes) == 0 && prune == nil {
+		return nil
+	}
+
+	restrictions, err := bbAPI.GetBranchRestrictions(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+
+	// Adding an existing push restriction doesn't change who may push, so
+	// existing restrictions are updated instead
 	for branch, permissions := range policies.AllowPushes {
-		if err := bbAPI.AddBranchRestriction(owner, repo, "push", branch, permissions.Users, permissions.Groups); err != nil {
+		restriction, ok := findBranchRestriction(restrictions, "push", branch)
+		if !ok {
+			if err := bbAPI.AddBranchRestriction(ctx, owner, repo, "push", branch, permissions.Users, permissions.Groups); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if users, groups, changed := pushRestrictionMembers(restriction, permissions, prune != nil); changed {
+			restriction.Users, restriction.Groups = users, groups
+			if err := bbAPI.UpdateBranchRestriction(ctx, owner, repo, restriction); err != nil {
+				return err
+			}
+		}
+	}
+
+	if prune == nil {
+		return nil
+	}
+
+	for _, restriction := range extraBranchRestrictions(restrictions, policies, prune.Branches) {
+		if err := ignoreNotFound(bbAPI.DeleteBranchRestriction(ctx, owner, repo, restriction.ID)); err != nil {
 			return err
 		}
 	}
@@ -258,8 +547,8 @@ func (hooks *bbServices) hasPOSTHook(URL string) bool {
 	return false
 }
 
-func enforcePOSTHooks(owner string, repo string, hookURLs []string) error {
-	hookList, err := bbAPI.GetServices(owner, repo)
+func enforcePOSTHooks(ctx context.Context, owner string, repo string, hookURLs []string, prune *pruneAllowlist) error {
+	hookList, err := bbAPI.GetServices(ctx, owner, repo)
 
 	if err != nil {
 		return err
@@ -269,7 +558,15 @@ func enforcePOSTHooks(owner string, repo string, hookURLs []string) error {
 
 	for _, url := range hookURLs {
 		if !currentHooks.hasPOSTHook(url) {
-			if err := bbAPI.AddService(owner, repo, "POST", map[string]string{"URL": url}); err != nil {
+			if err := bbAPI.AddService(ctx, owner, repo, "POST", map[string]string{"URL": url}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if prune != nil {
+		for _, hook := range extraPOSTHooks(hookList, hookURLs, prune.PostHooks) {
+			if err := ignoreNotFound(bbAPI.DeleteService(ctx, owner, repo, hook.UUID)); err != nil {
 				return err
 			}
 		}
@@ -296,10 +593,13 @@ This method ensures the presence of all required keys.
   are added again, this time with the correct name.
 - It adds keys that are not present.
 - It doesn't remove keys that are present in Bitbucket but not in the policy
-  file.
+  file, unless the policy prunes and the key label isn't in the allowlist.
 */
-func enforceDeployKeys(owner string, repo string, keys publicKeyList) error {
-	currkeys, _ := bbAPI.GetDeployKeys(owner, repo)
+func enforceDeployKeys(ctx context.Context, owner string, repo string, keys publicKeyList, prune *pruneAllowlist) error {
+	currkeys, err := bbAPI.GetDeployKeys(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
 
 	newkeys := make(publicKeyList, len(keys))
 	copy(newkeys, keys)
@@ -309,7 +609,7 @@ func enforceDeployKeys(owner string, repo string, keys publicKeyList) error {
 
 		if match == matchContent {
 			// Delete the key from BB so it can be reuploaded with proper name
-			if err := bbAPI.DeleteDeployKey(owner, repo, key.ID); err != nil {
+			if err := ignoreNotFound(bbAPI.DeleteDeployKey(ctx, owner, repo, key.ID)); err != nil {
 				return err
 			}
 		} else if match == matchExact {
@@ -319,27 +619,90 @@ func enforceDeployKeys(owner string, repo string, keys publicKeyList) error {
 	}
 
 	for _, key := range newkeys {
-		if err := bbAPI.AddDeployKey(owner, repo, key.Name, key.Key); err != nil {
+		if err := bbAPI.AddDeployKey(ctx, owner, repo, key.Name, key.Key); err != nil {
 			return err
 		}
 	}
 
+	if prune != nil {
+		for _, key := range extraDeployKeys(currkeys, keys, prune.DeployKeys) {
+			if err := ignoreNotFound(bbAPI.DeleteDeployKey(ctx, owner, repo, key.ID)); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+// changedPolicies returns the names of policies that have been added, changed
+// or removed
+func changedPolicies(old map[string]string, current map[string]string) []string {
+	var changed []string
+
+	for policyname, hash := range current {
+		if old[policyname] != hash {
+			changed = append(changed, policyname)
+		}
+	}
+
+	for policyname := range old {
+		if _, ok := current[policyname]; !ok {
+			changed = append(changed, policyname)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
+
+// parseConfig reads a policy, including the policies it extends. The daemon
+// uses the last good version loaded by the policy store instead.
 func parseConfig(configFile string) (repositorySettings, error) {
-	rawConfig, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.json", *configDir, configFile))
+	if policies != nil {
+		return policies.get(configFile)
+	}
+
+	config, err := resolvePolicy(configFile, nil)
 	if err != nil {
 		return repositorySettings{}, err
 	}
 
-	var config repositorySettings
-	if err := json.Unmarshal(rawConfig, &config); err != nil {
+	if *verbose {
+		log.Info("Loaded config: ", redact(fmt.Sprint(config)))
+	}
+
+	return config, nil
+}
+
+// readPolicy reads and validates a single policy file
+func readPolicy(policyname string) (repositorySettings, error) {
+	filename, err := findPolicyFile(policyname)
+	if err != nil {
 		return repositorySettings{}, err
 	}
 
-	if *verbose {
-		log.Info("Loaded config: ", config)
+	rawConfig, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return repositorySettings{}, err
+	}
+
+	if rawConfig, err = policyJSON(filename, rawConfig); err != nil {
+		return repositorySettings{}, err
+	}
+
+	if rawConfig, err = resolveReferences(filename, rawConfig); err != nil {
+		return repositorySettings{}, err
+	}
+
+	if errs := validatePolicy(filename, rawConfig); len(errs) > 0 {
+		return repositorySettings{}, errs
+	}
+
+	var config repositorySettings
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return repositorySettings{}, fmt.Errorf("Error reading policy '%s': %s", policyname, err)
 	}
 
 	return config, nil
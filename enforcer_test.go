@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket/fake"
+	"github.com/jumoel/bitbucket-enforcer/gobucket/testserver"
+)
+
+var testPolicies = map[string]string{
+	"default.json": `{"private": false, "forks": "none"}`,
+	"service.json": `{
+		"prune": true,
+		"posthooks": ["https://ci.example.com/hooks/{{.Repo}}"],
+		"accessmanagement": {"groups": {"{{.Labels.team}}-maintainers": "admin"}}
+	}`,
+}
+
+/*
+Points the enforcer at a new test server, with the policies in a new config
+folder and an empty state file. The previous client, config folder and state
+are restored when the test ends.
+*/
+func useTestServer(t *testing.T, policyFiles map[string]string) *testserver.Server {
+	server := testserver.New(nil)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	for filename, policy := range policyFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldAPI, oldState, oldConfigDir, oldPolicies := bbAPI, state, *configDir, policies
+	t.Cleanup(func() {
+		bbAPI, state, *configDir, policies = oldAPI, oldState, oldConfigDir, oldPolicies
+	})
+
+	var err error
+	bbAPI = server.Client()
+	*configDir = dir
+	policies = nil
+	if state, err = openStateStore(filepath.Join(dir, "state.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+func TestEnforceAll(t *testing.T) {
+	server := useTestServer(t, testPolicies)
+	server.PageLen = 2
+
+	bb := server.Bitbucket
+	bb.AddRepository("acme", "web", "")
+	bb.AddRepository("acme", "api", "-enforce=service -team=payments")
+	bb.AddRepository("acme", "legacy", "-noenforce")
+	bb.AddService(context.Background(), "acme", "api", "POST", map[string]string{"URL": "https://old.example.com"})
+
+	failed, err := enforceAll(context.Background(), "acme", false)
+	if err != nil || failed != 0 {
+		t.Fatalf("enforceAll failed for %d repositories: %v", failed, err)
+	}
+
+	web := bb.Repository("acme", "web")
+	if web.Private || web.Forks != "none" {
+		t.Errorf("default policy not enforced on acme/web: %+v", web)
+	}
+
+	api := bb.Repository("acme", "api")
+	if len(api.Hooks) != 1 || api.Hooks[0].Service.Fields[0].Value != "https://ci.example.com/hooks/api" {
+		t.Errorf("expected only the templated hook on acme/api, got %+v", api.Hooks)
+	}
+	if api.GroupPrivileges["payments-maintainers"] != "admin" || len(api.GroupPrivileges) != 1 {
+		t.Errorf("unexpected group privileges on acme/api: %v", api.GroupPrivileges)
+	}
+
+	if legacy := bb.Repository("acme", "legacy"); !legacy.Private {
+		t.Error("acme/legacy was enforced despite '-noenforce'")
+	}
+
+	for _, name := range []string{"acme/web", "acme/api"} {
+		if record, ok := state.get(name); !ok || !record.succeeded() {
+			t.Errorf("no successful enforcement recorded for %s", name)
+		}
+	}
+
+	// Enforced repositories are left alone until their policy changes
+	web.Private = true
+	if failed, err := enforceAll(context.Background(), "acme", false); err != nil || failed != 0 {
+		t.Fatalf("second enforceAll failed for %d repositories: %v", failed, err)
+	}
+	if !bb.Repository("acme", "web").Private {
+		t.Error("acme/web was enforced again without a policy change")
+	}
+}
+
+func TestPruneKeepsGrantedUsers(t *testing.T) {
+	const alice, mallory = "5b10ac8d82e05b22cc7d4ef5", "5b10ac8d82e05b22cc7d4ef6"
+
+	server := useTestServer(t, map[string]string{
+		"default.json": `{"prune": true, "accessmanagement": {"users": {"` + alice + `": "write"}}}`,
+	})
+
+	ctx := context.Background()
+	bb := server.Bitbucket
+	bb.AddRepository("acme", "api", "")
+	bb.AddUserPrivilege(ctx, "acme", "api", fake.AccountID, "admin")
+	bb.AddUserPrivilege(ctx, "acme", "api", mallory, "admin")
+
+	repo, err := bbAPI.GetRepository(ctx, "acme", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := enforceRepository(ctx, repo, "default"); err != nil {
+			t.Fatal(err)
+		}
+
+		privileges := bb.Repository("acme", "api").UserPrivileges
+		if len(privileges) != 2 || privileges[alice] != "write" || privileges[fake.AccountID] != "admin" {
+			t.Fatalf("pass %d: expected the granted user and the enforcing account to remain, got %v", i+1, privileges)
+		}
+	}
+}
+
+func TestEnforcedTagWithoutState(t *testing.T) {
+	server := useTestServer(t, map[string]string{"default.json": `{"private": false}`})
+	server.Bitbucket.AddRepository("acme", "old", "Enforced by an earlier version\n\n-enforced")
+
+	defer func(old bool) { *descriptionTag = old }(*descriptionTag)
+	*descriptionTag = false
+
+	if failed, err := enforceAll(context.Background(), "acme", false); err != nil || failed != 0 {
+		t.Fatalf("enforceAll failed for %d repositories: %v", failed, err)
+	}
+
+	if !server.Bitbucket.Repository("acme", "old").Private {
+		t.Error("a repository marked '-enforced' was enforced again")
+	}
+}
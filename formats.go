@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// policyExtensions are the file extensions of policies, in the order they are
+// looked for
+var policyExtensions = []string{".json", ".yaml", ".yml", ".toml"}
+
+// policyFile returns the path of the file containing a policy. If there is no
+// such file, it returns the path of the JSON file.
+func policyFile(policyname string) string {
+	if files := policyCandidates(policyname); len(files) > 0 {
+		return files[0]
+	}
+
+	return filepath.Join(*configDir, policyname+".json")
+}
+
+// findPolicyFile is like policyFile, but fails if more than one file contains
+// the policy, e.g. both default.json and default.yaml
+func findPolicyFile(policyname string) (string, error) {
+	files := policyCandidates(policyname)
+	if len(files) > 1 {
+		return "", fmt.Errorf("Policy '%s' is ambiguous, it is in %s", policyname, strings.Join(files, ", "))
+	}
+
+	return policyFile(policyname), nil
+}
+
+// policyExists reports whether there is a file containing the policy
+func policyExists(policyname string) bool {
+	return len(policyCandidates(policyname)) > 0
+}
+
+func policyCandidates(policyname string) []string {
+	var files []string
+
+	for _, extension := range policyExtensions {
+		file := filepath.Join(*configDir, policyname+extension)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// policyNames returns the names of all policies in the config folder, in any
+// format
+func policyNames() ([]string, error) {
+	seen := make(map[string]bool)
+	var policynames []string
+
+	for _, extension := range policyExtensions {
+		files, err := filepath.Glob(filepath.Join(*configDir, "*"+extension))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			policyname := strings.TrimSuffix(filepath.Base(file), extension)
+			if !seen[policyname] {
+				seen[policyname] = true
+				policynames = append(policynames, policyname)
+			}
+		}
+	}
+
+	sort.Strings(policynames)
+
+	return policynames, nil
+}
+
+/*
+Converts a YAML or TOML policy to JSON, so every format is validated and
+decoded into repositorySettings the same way. JSON policies are returned
+as-is, so syntax errors are reported with their position in the file.
+*/
+func policyJSON(filename string, raw []byte) ([]byte, error) {
+	var generic interface{}
+
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(raw, &generic); err != nil {
+			return nil, validationErrors{{filename, "", err.Error()}}
+		}
+
+	case ".toml":
+		var table map[string]interface{}
+		if err := toml.Unmarshal(raw, &table); err != nil {
+			return nil, validationErrors{{filename, "", err.Error()}}
+		}
+		generic = table
+
+	default:
+		return raw, nil
+	}
+
+	// An empty YAML file is an empty policy
+	if generic == nil {
+		generic = map[string]interface{}{}
+	}
+
+	return json.Marshal(jsonValue(generic))
+}
+
+// jsonValue converts YAML mappings with keys that aren't strings, e.g. a
+// group named 1234, to JSON objects
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, entry := range value {
+			value[key] = jsonValue(entry)
+		}
+
+		return value
+
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, entry := range value {
+			object[fmt.Sprint(key)] = jsonValue(entry)
+		}
+
+		return object
+
+	case []interface{}:
+		for i, entry := range value {
+			value[i] = jsonValue(entry)
+		}
+
+		return value
+
+	case []map[string]interface{}:
+		list := make([]interface{}, len(value))
+		for i, entry := range value {
+			list[i] = jsonValue(entry)
+		}
+
+		return list
+	}
+
+	return value
+}
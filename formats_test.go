@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var formatPolicies = map[string]string{
+	"json.json": `{
+		"private": true,
+		"forks": "none",
+		"deploykeys": [{"name": "ci", "key": "` + testSSHKey + `"}],
+		"branchmanagement": {"preventdelete": ["master"], "allowpushes": {"master": {"users": ["alice"]}}},
+		"accessmanagement": {"groups": {"1234": "read"}}
+	}`,
+	"yaml.yaml": `
+private: true
+forks: none
+deploykeys:
+  - name: ci
+    key: ` + testSSHKey + `
+branchmanagement:
+  preventdelete: [master]
+  allowpushes:
+    master:
+      users: [alice]
+accessmanagement:
+  groups:
+    1234: read
+`,
+	"toml.toml": `
+private = true
+forks = "none"
+
+[[deploykeys]]
+name = "ci"
+key = "` + testSSHKey + `"
+
+[branchmanagement]
+preventdelete = ["master"]
+
+[branchmanagement.allowpushes.master]
+users = ["alice"]
+
+[accessmanagement.groups]
+"1234" = "read"
+`,
+}
+
+func TestPolicyFormatsMatch(t *testing.T) {
+	useTestServer(t, formatPolicies)
+
+	expected, err := resolvePolicy("json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expectedJSON interface{}
+	if err := json.Unmarshal([]byte(formatPolicies["json.json"]), &expectedJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policyname := range []string{"yaml", "toml"} {
+		filename := policyFile(policyname)
+
+		rawConfig, err := policyJSON(filename, []byte(formatPolicies[policyname+"."+policyname]))
+		if err != nil {
+			t.Errorf("%s: %s", policyname, err)
+			continue
+		}
+
+		var generic interface{}
+		if err := json.Unmarshal(rawConfig, &generic); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(generic, expectedJSON) {
+			t.Errorf("%s: expected the JSON %v, got %s", policyname, expectedJSON, rawConfig)
+		}
+
+		policy, err := resolvePolicy(policyname, nil)
+		if err != nil {
+			t.Errorf("%s: %s", policyname, err)
+			continue
+		}
+		if policyHash(policy) != policyHash(expected) {
+			t.Errorf("%s: expected the same hash as the JSON policy", policyname)
+		}
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	tests := []struct {
+		filename string
+		raw      string
+		err      string
+	}{
+		{"default.yaml", "private: true\nprivate: false\n", `mapping key "private" already defined`},
+		{"default.toml", "private = true\nprivate = false\n", "'private' has already been defined"},
+	}
+
+	for _, test := range tests {
+		_, err := policyJSON(test.filename, []byte(test.raw))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.filename, test.err, err)
+		}
+	}
+}
+
+func TestAmbiguousPolicy(t *testing.T) {
+	useTestServer(t, map[string]string{
+		"default.json": `{"private": true}`,
+		"default.yml":  "private: true\n",
+	})
+
+	_, err := readPolicy("default")
+	if err == nil || !strings.Contains(err.Error(), "Policy 'default' is ambiguous") {
+		t.Errorf("expected an ambiguous policy error, got %v", err)
+	}
+}
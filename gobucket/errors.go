@@ -0,0 +1,114 @@
+package gobucket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIError is a failed request to the BitBucket API. The message, detail and
+// field errors are parsed from the error JSON returned by the 2.0 API. If the
+// body isn't error JSON, e.g. an HTML error page, the message is the HTTP
+// status text.
+type APIError struct {
+	StatusCode StatusCode
+	Message    string
+	Detail     string
+	Fields     map[string][]string
+}
+
+// apiErrorResponse is the error JSON returned by the 2.0 API
+type apiErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Message string              `json:"message"`
+		Detail  json.RawMessage     `json:"detail"`
+		Fields  map[string][]string `json:"fields"`
+	} `json:"error"`
+}
+
+func newAPIError(resp *APIResponse) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+
+	var errResponse apiErrorResponse
+	if err := json.Unmarshal([]byte(resp.Body), &errResponse); err == nil && errResponse.Type == "error" {
+		apiErr.Message = errResponse.Error.Message
+		apiErr.Fields = errResponse.Error.Fields
+
+		// The detail is usually a string, but is sometimes an object
+		var detail string
+		if err := json.Unmarshal(errResponse.Error.Detail, &detail); err == nil {
+			apiErr.Detail = detail
+		} else if len(errResponse.Error.Detail) > 0 && string(errResponse.Error.Detail) != "null" {
+			apiErr.Detail = string(errResponse.Error.Detail)
+		}
+	}
+
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(int(resp.StatusCode))
+	}
+
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("[%d]: %s", e.StatusCode, e.Message)
+
+	if e.Detail != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Detail)
+	}
+
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		msg = fmt.Sprintf("%s; %s: %s", msg, field, strings.Join(e.Fields[field], ", "))
+	}
+
+	return msg
+}
+
+func hasStatus(err error, statusCodes ...StatusCode) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, statusCode := range statusCodes {
+		if apiErr.StatusCode == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsNotFound reports whether err is an APIError for a missing repository or
+// setting
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether err is an APIError for a setting that conflicts
+// with an existing one
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+// IsRateLimited reports whether err is an APIError for a request that was
+// rejected because of rate limiting, even after retrying
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// IsPermissionDenied reports whether err is an APIError for a request the
+// account isn't allowed to make, or whose credentials were rejected
+func IsPermissionDenied(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized, http.StatusForbidden)
+}
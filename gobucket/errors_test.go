@@ -0,0 +1,91 @@
+package gobucket
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNewAPIError(t *testing.T) {
+	tests := []struct {
+		statusCode StatusCode
+		body       string
+		expected   APIError
+		message    string
+	}{
+		{
+			http.StatusBadRequest,
+			`{"type": "error", "error": {"message": "Bad request", "detail": "Key is invalid", "fields": {"key": ["is invalid", "is too short"], "label": ["is required"]}}}`,
+			APIError{http.StatusBadRequest, "Bad request", "Key is invalid", map[string][]string{"key": {"is invalid", "is too short"}, "label": {"is required"}}},
+			"[400]: Bad request (Key is invalid); key: is invalid, is too short; label: is required",
+		},
+		{
+			http.StatusConflict,
+			`{"type": "error", "error": {"message": "Conflict", "detail": {"reason": "exists"}}}`,
+			APIError{http.StatusConflict, "Conflict", `{"reason": "exists"}`, nil},
+			`[409]: Conflict ({"reason": "exists"})`,
+		},
+		{
+			http.StatusNotFound,
+			`{"type": "error", "error": {"message": "Repository acme/api not found", "detail": null}}`,
+			APIError{http.StatusNotFound, "Repository acme/api not found", "", nil},
+			"[404]: Repository acme/api not found",
+		},
+		{
+			http.StatusBadGateway,
+			`<html><body>Bad gateway</body></html>`,
+			APIError{http.StatusBadGateway, "Bad Gateway", "", nil},
+			"[502]: Bad Gateway",
+		},
+		{
+			http.StatusForbidden,
+			`{"type": "repository", "error": {"message": "not an error"}}`,
+			APIError{http.StatusForbidden, "Forbidden", "", nil},
+			"[403]: Forbidden",
+		},
+	}
+
+	for _, test := range tests {
+		apiErr := newAPIError(&APIResponse{StatusCode: test.statusCode, Body: test.body})
+
+		if !reflect.DeepEqual(*apiErr, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.body, test.expected, *apiErr)
+		}
+		if apiErr.Error() != test.message {
+			t.Errorf("%s: expected the message '%s', got '%s'", test.body, test.message, apiErr)
+		}
+	}
+}
+
+func TestErrorPredicates(t *testing.T) {
+	predicates := map[string]func(error) bool{
+		"IsNotFound":         IsNotFound,
+		"IsConflict":         IsConflict,
+		"IsRateLimited":      IsRateLimited,
+		"IsPermissionDenied": IsPermissionDenied,
+	}
+
+	tests := []struct {
+		err      error
+		expected string // the predicate that matches, if any
+	}{
+		{&APIError{StatusCode: http.StatusNotFound}, "IsNotFound"},
+		{&APIError{StatusCode: http.StatusConflict}, "IsConflict"},
+		{&APIError{StatusCode: http.StatusTooManyRequests}, "IsRateLimited"},
+		{&APIError{StatusCode: http.StatusUnauthorized}, "IsPermissionDenied"},
+		{&APIError{StatusCode: http.StatusForbidden}, "IsPermissionDenied"},
+		{fmt.Errorf("Error getting repository: %w", &APIError{StatusCode: http.StatusNotFound}), "IsNotFound"},
+		{&APIError{StatusCode: http.StatusInternalServerError}, ""},
+		{fmt.Errorf("[404]: Not Found"), ""},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		for name, predicate := range predicates {
+			if matches := predicate(test.err); matches != (name == test.expected) {
+				t.Errorf("%s(%v): expected %v", name, test.err, !matches)
+			}
+		}
+	}
+}
@@ -0,0 +1,485 @@
+// Package fake provides an in-memory implementation of gobucket.Client that
+// can be used to test enforcement policies without talking to BitBucket.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+// Repository holds the settings of a single fake repository
+type Repository struct {
+	Owner           string
+	Slug            string
+	Description     string
+	Private         bool
+	Forks           string
+	IssueTracker    bool
+	DeployKeys      []gobucket.DeployKey
+	Hooks           []gobucket.Service
+	Restrictions    []gobucket.BranchRestriction
+	UserPrivileges  map[string]string // account IDs => permissions
+	GroupPrivileges map[string]string // groupnames => permissions
+	Language        string
+	ProjectKey      string
+}
+
+// FullName returns the "owner/slug" name of the repository
+func (r *Repository) FullName() string {
+	return fmt.Sprintf("%s/%s", r.Owner, r.Slug)
+}
+
+var forkPolicies = map[string]string{
+	"none":    "no_forks",
+	"private": "no_public_forks",
+	"public":  "allow_forks",
+}
+
+// APIRepository returns the repository as it would be returned by the API
+func (r *Repository) APIRepository() gobucket.Repository {
+	return gobucket.Repository{
+		FullName:    r.FullName(),
+		Description: r.Description,
+		IsPrivate:   r.Private,
+		HasIssues:   r.IssueTracker,
+		ForkPolicy:  forkPolicies[r.Forks],
+		Name:        r.Slug,
+		Language:    r.Language,
+		Project:     gobucket.Project{Key: r.ProjectKey},
+	}
+}
+
+func copyPrivileges(privileges map[string]string) map[string]string {
+	result := make(map[string]string, len(privileges))
+	for entity, privilege := range privileges {
+		result[entity] = privilege
+	}
+
+	return result
+}
+
+// AccountID is the account ID of the user the fake is authenticated as
+const AccountID = "5b10ac8d82e05b22cc7d4e00"
+
+// Client is an in-memory gobucket.Client. It is safe for concurrent use.
+type Client struct {
+	mu       sync.Mutex
+	repos    map[string]*Repository
+	order    []string
+	nextID   int
+	revision int
+}
+
+var _ gobucket.Client = (*Client)(nil)
+
+// New returns an empty fake BitBucket
+func New() *Client {
+	return &Client{repos: make(map[string]*Repository)}
+}
+
+// AddRepository creates a new repository with default settings and returns it
+func (c *Client) AddRepository(owner string, slug string, description string) *Repository {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo := &Repository{
+		Owner:           owner,
+		Slug:            slug,
+		Description:     description,
+		Private:         true,
+		Forks:           "private",
+		UserPrivileges:  make(map[string]string),
+		GroupPrivileges: make(map[string]string),
+	}
+
+	name := repo.FullName()
+	if _, exists := c.repos[name]; !exists {
+		c.order = append(c.order, name)
+	}
+	c.repos[name] = repo
+	c.revision++
+
+	return repo
+}
+
+// Repository returns the repository with the given owner and slug, or nil if
+// it doesn't exist. The returned value may be inspected and modified, but
+// not while other goroutines use the client.
+func (c *Client) Repository(owner string, slug string) *Repository {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.repos[fmt.Sprintf("%s/%s", owner, slug)]
+}
+
+// apiError returns an error like the ones returned by gobucket.APIClient
+func apiError(statusCode int, format string, args ...interface{}) error {
+	return &gobucket.APIError{StatusCode: gobucket.StatusCode(statusCode), Message: fmt.Sprintf(format, args...)}
+}
+
+func (c *Client) lookup(ctx context.Context, owner string, slug string) (*Repository, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	repo, ok := c.repos[fmt.Sprintf("%s/%s", owner, slug)]
+	if !ok {
+		return nil, apiError(404, "Repository %s/%s not found", owner, slug)
+	}
+
+	return repo, nil
+}
+
+// update looks up a repository and applies fn to it while holding the lock
+func (c *Client) update(ctx context.Context, owner string, slug string, fn func(repo *Repository) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := c.lookup(ctx, owner, slug)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(repo); err != nil {
+		return err
+	}
+
+	c.revision++
+
+	return nil
+}
+
+// GetRepositories returns a list of all repositories owned by `owner`
+func (c *Client) GetRepositories(ctx context.Context, owner string) ([]gobucket.Repository, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var repos []gobucket.Repository
+	for _, name := range c.order {
+		repo := c.repos[name]
+		if repo.Owner == owner {
+			repos = append(repos, repo.APIRepository())
+		}
+	}
+
+	return repos, nil
+}
+
+// GetRepository returns the properties of a single repository
+func (c *Client) GetRepository(ctx context.Context, owner string, repo string) (gobucket.Repository, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, err := c.lookup(ctx, owner, repo)
+	if err != nil {
+		return gobucket.Repository{}, err
+	}
+
+	return r.APIRepository(), nil
+}
+
+// RepositoriesChanged reports a change whenever any repository has been
+// modified since the ETag was handed out
+func (c *Client) RepositoriesChanged(ctx context.Context, owner string, etag string) (bool, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return false, etag, err
+	}
+
+	currentEtag := fmt.Sprintf("\"%d\"", c.revision)
+
+	return etag != currentEtag, currentEtag, nil
+}
+
+// GetBranchRestrictions returns the branch restrictions on a repository
+func (c *Client) GetBranchRestrictions(ctx context.Context, owner string, repo string) ([]gobucket.BranchRestriction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, err := c.lookup(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]gobucket.BranchRestriction(nil), r.Restrictions...), nil
+}
+
+// AddBranchRestriction adds a new branch restriction to a repository. Adding
+// an existing kind and pattern is a no-op, like a conflict in BitBucket.
+func (c *Client) AddBranchRestriction(ctx context.Context, owner string, repo string, kind string, branchpattern string, users []string, groups []string) error {
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		for _, restriction := range r.Restrictions {
+			if restriction.Kind == kind && restriction.Pattern == branchpattern {
+				return nil
+			}
+		}
+
+		c.nextID++
+		r.Restrictions = append(r.Restrictions, gobucket.BranchRestriction{
+			ID:      c.nextID,
+			Kind:    kind,
+			Pattern: branchpattern,
+			Users:   append([]string(nil), users...),
+			Groups:  append([]string(nil), groups...),
+		})
+
+		return nil
+	})
+}
+
+// UpdateBranchRestriction replaces the users and groups of a branch restriction
+func (c *Client) UpdateBranchRestriction(ctx context.Context, owner string, repo string, restriction gobucket.BranchRestriction) error {
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		for i, existing := range r.Restrictions {
+			if existing.ID == restriction.ID {
+				r.Restrictions[i].Users = append([]string(nil), restriction.Users...)
+				r.Restrictions[i].Groups = append([]string(nil), restriction.Groups...)
+				return nil
+			}
+		}
+
+		return apiError(404, "Branch restriction %d not found on %s", restriction.ID, r.FullName())
+	})
+}
+
+// DeleteBranchRestriction removes a branch restriction from a repository
+func (c *Client) DeleteBranchRestriction(ctx context.Context, owner string, repo string, restrictionID int) error {
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		for i, restriction := range r.Restrictions {
+			if restriction.ID == restrictionID {
+				r.Restrictions = append(r.Restrictions[:i], r.Restrictions[i+1:]...)
+				return nil
+			}
+		}
+
+		return apiError(404, "Branch restriction %d not found on %s", restrictionID, r.FullName())
+	})
+}
+
+func validPrivilege(privilege string) error {
+	if !(privilege == "read" || privilege == "write" || privilege == "admin") {
+		return fmt.Errorf("Wrong privilege ('%s'). One of 'read', 'write' or 'admin' required.", privilege)
+	}
+
+	return nil
+}
+
+// AddUserPrivilege adds a privilege for a user on a repository
+func (c *Client) AddUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string, privilege string) error {
+	if err := validPrivilege(privilege); err != nil {
+		return err
+	}
+
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		r.UserPrivileges[privilegeUser] = privilege
+		return nil
+	})
+}
+
+// AddGroupPrivilege adds a privilege for a group on a repository
+func (c *Client) AddGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string, privilege string) error {
+	if err := validPrivilege(privilege); err != nil {
+		return err
+	}
+
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		r.GroupPrivileges[privilegeGroup] = privilege
+		return nil
+	})
+}
+
+// GetUserPrivileges returns the user privileges on a repository
+func (c *Client) GetUserPrivileges(ctx context.Context, owner string, repo string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, err := c.lookup(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyPrivileges(r.UserPrivileges), nil
+}
+
+// GetGroupPrivileges returns the group privileges on a repository
+func (c *Client) GetGroupPrivileges(ctx context.Context, owner string, repo string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, err := c.lookup(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return copyPrivileges(r.GroupPrivileges), nil
+}
+
+// DeleteUserPrivilege removes the privilege of a user on a repository
+func (c *Client) DeleteUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string) error {
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		return deletePrivilege(r, r.UserPrivileges, privilegeUser)
+	})
+}
+
+// DeleteGroupPrivilege removes the privilege of a group on a repository
+func (c *Client) DeleteGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string) error {
+	return c.update(ctx, owner, repo, func(r *Repository) error {
+		return deletePrivilege(r, r.GroupPrivileges, privilegeGroup)
+	})
+}
+
+func deletePrivilege(r *Repository, privileges map[string]string, entity string) error {
+	if _, ok := privileges[entity]; !ok {
+		return apiError(404, "No privilege for %s on %s", entity, r.FullName())
+	}
+
+	delete(privileges, entity)
+
+	return nil
+}
+
+// GetServices returns a list of the service hooks attached to a repository
+func (c *Client) GetServices(ctx context.Context, owner string, repository string) ([]gobucket.Service, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, err := c.lookup(ctx, owner, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]gobucket.Service(nil), repo.Hooks...), nil
+}
+
+// AddService attaches a new service hook to the repository
+func (c *Client) AddService(ctx context.Context, owner string, repository string, servicetype string, parameters map[string]string) error {
+	if servicetype != "POST" {
+		return fmt.Errorf("Unsupported service type ('%s'). Only 'POST' is supported.", servicetype)
+	}
+
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		c.nextID++
+
+		hook := gobucket.Service{ID: c.nextID, UUID: fmt.Sprintf("{%d}", c.nextID)}
+		hook.Service.Type = servicetype
+		hook.Service.Fields = []gobucket.ServiceField{{Name: "URL", Value: parameters["URL"]}}
+
+		r.Hooks = append(r.Hooks, hook)
+
+		return nil
+	})
+}
+
+// DeleteService removes a service hook from the repository
+func (c *Client) DeleteService(ctx context.Context, owner string, repository string, serviceUUID string) error {
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		for i, hook := range r.Hooks {
+			if hook.UUID == serviceUUID {
+				r.Hooks = append(r.Hooks[:i], r.Hooks[i+1:]...)
+				return nil
+			}
+		}
+
+		return apiError(404, "Hook %s not found on %s", serviceUUID, r.FullName())
+	})
+}
+
+// GetDeployKeys returns a list of all deploy keys attached to a repository
+func (c *Client) GetDeployKeys(ctx context.Context, owner string, repo string) ([]gobucket.DeployKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, err := c.lookup(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]gobucket.DeployKey(nil), r.DeployKeys...), nil
+}
+
+// AddDeployKey attaches a new deploy key to a repository. Like BitBucket, it
+// refuses to add a key whose content is already present.
+func (c *Client) AddDeployKey(ctx context.Context, owner string, repository string, name string, key string) error {
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		for _, existing := range r.DeployKeys {
+			if strings.TrimSpace(existing.Key) == strings.TrimSpace(key) {
+				return apiError(400, "Deploy key already exists on %s", r.FullName())
+			}
+		}
+
+		c.nextID++
+		r.DeployKeys = append(r.DeployKeys, gobucket.DeployKey{ID: c.nextID, Key: key, Label: name})
+
+		return nil
+	})
+}
+
+// DeleteDeployKey removes a deploy key from a repository
+func (c *Client) DeleteDeployKey(ctx context.Context, owner string, repository string, keyID int) error {
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		for i, key := range r.DeployKeys {
+			if key.ID == keyID {
+				r.DeployKeys = append(r.DeployKeys[:i], r.DeployKeys[i+1:]...)
+				return nil
+			}
+		}
+
+		return apiError(404, "Deploy key %d not found on %s", keyID, r.FullName())
+	})
+}
+
+// SetPrivacy set the repository privacy/visibility
+func (c *Client) SetPrivacy(ctx context.Context, owner string, repository string, isPrivate bool) error {
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		r.Private = isPrivate
+		return nil
+	})
+}
+
+// SetIssueTracker sets whether the repository has an issue tracker
+func (c *Client) SetIssueTracker(ctx context.Context, owner string, repository string, issueTracker bool) error {
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		r.IssueTracker = issueTracker
+		return nil
+	})
+}
+
+// SetDescription sets the description of the repository
+func (c *Client) SetDescription(ctx context.Context, owner string, repository string, description string) error {
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		r.Description = description
+		return nil
+	})
+}
+
+// SetForks set the forking policy for the repository: "none", "private" or "public"
+func (c *Client) SetForks(ctx context.Context, owner string, repository string, forks string) error {
+	if _, ok := forkPolicies[forks]; !ok {
+		return fmt.Errorf("Wrong fork policy ('%s'). One of 'none', 'private' or 'public' required.", forks)
+	}
+
+	return c.update(ctx, owner, repository, func(r *Repository) error {
+		r.Forks = forks
+		return nil
+	})
+}
+
+// CurrentUser returns the account the fake is authenticated as, whose ID is
+// AccountID
+func (c *Client) CurrentUser(ctx context.Context) (gobucket.User, error) {
+	if err := ctx.Err(); err != nil {
+		return gobucket.User{}, err
+	}
+
+	return gobucket.User{AccountID: AccountID, UUID: "{enforcer}", Nickname: "enforcer"}, nil
+}
@@ -0,0 +1,98 @@
+package fake
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+func TestRepositorySettings(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+	client.AddRepository("acme", "api", "The API")
+	client.AddRepository("other", "web", "")
+
+	repos, err := client.GetRepositories(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0].FullName != "acme/api" || repos[0].ForkPolicy != "no_public_forks" {
+		t.Fatalf("unexpected repositories: %+v", repos)
+	}
+
+	if err := client.SetPrivacy(ctx, "acme", "api", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetForks(ctx, "acme", "api", "none"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetForks(ctx, "acme", "api", "everyone"); err == nil {
+		t.Fatal("expected an error for an unknown fork policy")
+	}
+
+	repo, err := client.GetRepository(ctx, "acme", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.IsPrivate || repo.ForkPolicy != "no_forks" {
+		t.Fatalf("settings not applied: %+v", repo)
+	}
+}
+
+func TestDeployKeys(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+	client.AddRepository("acme", "api", "")
+
+	if err := client.AddDeployKey(ctx, "acme", "api", "ci", "ssh-ed25519 AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddDeployKey(ctx, "acme", "api", "ci2", "ssh-ed25519 AAAA\n"); err == nil {
+		t.Fatal("expected an error when adding a key that is already present")
+	}
+
+	keys, err := client.GetDeployKeys(ctx, "acme", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Label != "ci" {
+		t.Fatalf("unexpected deploy keys: %+v", keys)
+	}
+
+	if err := client.DeleteDeployKey(ctx, "acme", "api", keys[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DeleteDeployKey(ctx, "acme", "api", keys[0].ID); !gobucket.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestMissingRepository(t *testing.T) {
+	_, err := New().GetRepository(context.Background(), "acme", "missing")
+	if !gobucket.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestRepositoriesChanged(t *testing.T) {
+	ctx := context.Background()
+	client := New()
+	client.AddRepository("acme", "api", "")
+
+	changed, etag, err := client.RepositoriesChanged(ctx, "acme", "")
+	if err != nil || !changed {
+		t.Fatalf("expected a change without an ETag, got %v, %v", changed, err)
+	}
+
+	if changed, _, _ := client.RepositoriesChanged(ctx, "acme", etag); changed {
+		t.Fatal("expected no change with the current ETag")
+	}
+
+	if err := client.SetDescription(ctx, "acme", "api", "-enforced"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _, _ := client.RepositoriesChanged(ctx, "acme", etag); !changed {
+		t.Fatal("expected a change after modifying a repository")
+	}
+}
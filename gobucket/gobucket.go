@@ -2,19 +2,102 @@ package gobucket
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Client is the set of BitBucket operations used to enforce policies. It is
+// implemented by APIClient and by the in-memory fake in gobucket/fake.
+type Client interface {
+	GetRepositories(ctx context.Context, owner string) ([]Repository, error)
+	GetRepository(ctx context.Context, owner string, repo string) (Repository, error)
+	RepositoriesChanged(ctx context.Context, owner string, etag string) (bool, string, error)
+	GetBranchRestrictions(ctx context.Context, owner string, repo string) ([]BranchRestriction, error)
+	AddBranchRestriction(ctx context.Context, owner string, repo string, kind string, branchpattern string, users []string, groups []string) error
+	UpdateBranchRestriction(ctx context.Context, owner string, repo string, restriction BranchRestriction) error
+	DeleteBranchRestriction(ctx context.Context, owner string, repo string, restrictionID int) error
+	AddUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string, privilege string) error
+	AddGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string, privilege string) error
+	GetUserPrivileges(ctx context.Context, owner string, repo string) (map[string]string, error)
+	GetGroupPrivileges(ctx context.Context, owner string, repo string) (map[string]string, error)
+	DeleteUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string) error
+	DeleteGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string) error
+	GetServices(ctx context.Context, owner string, repository string) ([]Service, error)
+	AddService(ctx context.Context, owner string, repository string, servicetype string, parameters map[string]string) error
+	DeleteService(ctx context.Context, owner string, repository string, serviceUUID string) error
+	GetDeployKeys(ctx context.Context, owner string, repo string) ([]DeployKey, error)
+	AddDeployKey(ctx context.Context, owner string, repository string, name string, key string) error
+	DeleteDeployKey(ctx context.Context, owner string, repository string, keyID int) error
+	SetPrivacy(ctx context.Context, owner string, repository string, isPrivate bool) error
+	SetIssueTracker(ctx context.Context, owner string, repository string, issueTracker bool) error
+	SetDescription(ctx context.Context, owner string, repository string, description string) error
+	SetForks(ctx context.Context, owner string, repository string, forks string) error
+	CurrentUser(ctx context.Context) (User, error)
+}
+
+var _ Client = (*APIClient)(nil)
+
 // APIClient that holds the required objects for API interaction
 type APIClient struct {
-	Key  string
-	Pass string
-	HTTP *http.Client
+	Key     string
+	Pass    string
+	BaseURL string
+	HTTP    *http.Client
+
+	// Timeout limits each attempt of a request, in addition to the deadline
+	// of the context given to the request. 0 means no limit.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times a failed request is retried
+	MaxRetries int
+	// RetryDelay is the base delay between retries, which is doubled for
+	// every retry unless the API asks for a specific delay
+	RetryDelay time.Duration
+	// MaxRetryDelay caps the delay between retries
+	MaxRetryDelay time.Duration
+	// OnRetry is called before a request is retried, if set
+	OnRetry func(method string, url string, attempt int, delay time.Duration, reason string)
+
+	limiter *rateLimiter
+	retries int64
+
+	userMu sync.Mutex
+	user   *User
+}
+
+// rateLimiter spaces requests evenly, so at most one request is started per
+// interval
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the next request may be started, or until the context
+// is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	return sleep(ctx, delay)
 }
 
 // StatusCode wraps HTTP status codes returned by the BitBucket API
@@ -25,40 +108,107 @@ type APIResponse struct {
 	Header     http.Header
 	StatusCode StatusCode
 	Body       string
+	Retries    int
 }
 
 // Repository contains the desireds repository properties
 type Repository struct {
-	FullName    string `json:"full_name"`
-	Description string
+	FullName    string  `json:"full_name"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	IsPrivate   bool    `json:"is_private"`
+	HasIssues   bool    `json:"has_issues"`
+	ForkPolicy  string  `json:"fork_policy"`
+	Language    string  `json:"language"`
+	Project     Project `json:"project"`
+
+	// Creator is the user who created the repository. It isn't returned by
+	// the API, so it is only known from 'repo:created' webhook events.
+	Creator string `json:"-"`
+}
+
+// Project is the project a repository belongs to
+type Project struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+}
+
+// Forks returns the forking policy in the format used by SetForks
+func (r Repository) Forks() string {
+	switch r.ForkPolicy {
+	case "no_forks":
+		return "none"
+	case "no_public_forks":
+		return "private"
+	case "allow_forks":
+		return "public"
+	}
+
+	return r.ForkPolicy
 }
 
-// RepositoryResponse contains the support information returned by the API
-type RepositoryResponse struct {
-	PageLen      int
-	Size         int
-	Repositories []Repository `json:"values"`
+// User is a Bitbucket account
+type User struct {
+	AccountID string `json:"account_id"`
+	UUID      string `json:"uuid"`
+	Nickname  string `json:"nickname"`
 }
 
 // DeployKey contains the desired deploy key properties
 type DeployKey struct {
-	ID    int `json:"pk"`
-	Key   string
-	Label string
+	ID      int    `json:"id"`
+	Key     string `json:"key"`
+	Label   string `json:"label"`
+	Comment string `json:"comment"`
+}
+
+// ServiceField is a single named setting on a service hook
+type ServiceField struct {
+	Name  string
+	Value string
 }
 
 // Service contains properties for service hooks on a repository
 type Service struct {
 	ID      int
+	UUID    string
 	Service struct {
-		Fields []struct {
-			Name  string
-			Value string
-		}
-		Type string
+		Fields []ServiceField
+		Type   string
 	}
 }
 
+type webhook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	URL         string   `json:"url"`
+	Description string   `json:"description"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events"`
+}
+
+type permission struct {
+	Permission string `json:"permission"`
+}
+
+type entityPermission struct {
+	Permission string `json:"permission"`
+	User       struct {
+		AccountID string `json:"account_id"`
+	} `json:"user"`
+	Group struct {
+		Slug string `json:"slug"`
+	} `json:"group"`
+}
+
+// BranchRestriction contains the properties of a branch restriction
+type BranchRestriction struct {
+	ID      int
+	Kind    string
+	Pattern string
+	Users   []string
+	Groups  []string
+}
+
 type restrictionUser struct {
 	Username string `json:"username"`
 }
@@ -69,13 +219,30 @@ type restrictionGroup struct {
 }
 
 type branchRestriction struct {
+	ID      int                `json:"id,omitempty"`
 	Kind    string             `json:"kind"`
 	Pattern string             `json:"pattern"`
 	Groups  []restrictionGroup `json:"groups"`
 	Users   []restrictionUser  `json:"users"`
 }
 
-const baseURL string = "https://bitbucket.org/api"
+// DefaultBaseURL is the address of the BitBucket Cloud API
+const DefaultBaseURL string = "https://bitbucket.org/api"
+
+// DefaultTimeout is the default time limit for a single API request
+const DefaultTimeout = 30 * time.Second
+
+// SetRateLimit limits the client to the given number of requests per period.
+// The limit is shared by all goroutines using the client. A limit of 0
+// removes the limit.
+func (c *APIClient) SetRateLimit(requests int, per time.Duration) {
+	if requests <= 0 {
+		c.limiter = nil
+		return
+	}
+
+	c.limiter = &rateLimiter{interval: per / time.Duration(requests)}
+}
 
 // New returns an API client for BitBucket
 func New(key string, pass string) *APIClient {
@@ -83,35 +250,77 @@ func New(key string, pass string) *APIClient {
 
 	client.Key = key
 	client.Pass = pass
+	client.BaseURL = DefaultBaseURL
 	client.HTTP = &http.Client{}
+	client.Timeout = DefaultTimeout
+	client.MaxRetries = 5
+	client.RetryDelay = time.Second
+	client.MaxRetryDelay = 2 * time.Minute
 
 	return client
 }
 
-func (c *APIClient) callFormEnc(version string, endpoint string, method string, params url.Values) (*APIResponse, error) {
-	if params == nil {
-		params = url.Values{}
-	}
+func (c *APIClient) callJSONEnc(ctx context.Context, version string, endpoint string, method string, params interface{}) (*APIResponse, error) {
+	payload, _ := json.Marshal(params)
 
-	payload := params.Encode()
+	return c.call(ctx, version, endpoint, method, "application/json", bytes.NewBuffer(payload))
+}
 
-	return c.call(version, endpoint, method, "application/x-www-form-urlencoded", bytes.NewBufferString(payload))
+func (c *APIClient) callNoBody(ctx context.Context, version string, endpoint string, method string) (*APIResponse, error) {
+	return c.call(ctx, version, endpoint, method, "", &bytes.Buffer{})
 }
 
-func (c *APIClient) callJSONEnc(version string, endpoint string, method string, params interface{}) (*APIResponse, error) {
-	payload, _ := json.Marshal(params)
+func (c *APIClient) call(ctx context.Context, version string, endpoint string, method string, contentType string, payload *bytes.Buffer) (*APIResponse, error) {
+	return c.do(ctx, c.url(version, endpoint), method, contentType, payload.Bytes())
+}
 
-	return c.call(version, endpoint, method, "application/json", bytes.NewBuffer(payload))
+func (c *APIClient) url(version string, endpoint string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(c.BaseURL, "/"), version, endpoint)
 }
 
-func (c *APIClient) callStringBody(version string, endpoint string, method string, payload string) (*APIResponse, error) {
-	return c.call(version, endpoint, method, "text/plain", bytes.NewBufferString(payload))
+// do makes a request to an absolute URL, retrying it if needed
+func (c *APIClient) do(ctx context.Context, apiurl string, method string, contentType string, payload []byte) (*APIResponse, error) {
+	for attempt := 0; ; attempt++ {
+		apiresp, err := c.callOnce(ctx, apiurl, method, contentType, payload)
+
+		if ctx.Err() != nil {
+			// Cancelled or past the deadline, so retrying is pointless
+			return nil, ctx.Err()
+		}
+
+		retry, reason := shouldRetry(method, apiresp, err)
+		if !retry || attempt >= c.MaxRetries {
+			if apiresp != nil {
+				apiresp.Retries = attempt
+			}
+			return apiresp, err
+		}
+
+		delay := c.retryDelay(attempt, apiresp)
+
+		atomic.AddInt64(&c.retries, 1)
+		if c.OnRetry != nil {
+			c.OnRetry(method, apiurl, attempt+1, delay, reason)
+		}
+
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
 }
 
-func (c *APIClient) call(version string, endpoint string, method string, contentType string, payload *bytes.Buffer) (*APIResponse, error) {
-	apiurl := fmt.Sprintf("%s/%s/%s", baseURL, version, endpoint)
+func (c *APIClient) callOnce(ctx context.Context, apiurl string, method string, contentType string, payload []byte) (*APIResponse, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
 
-	req, err := http.NewRequest(method, apiurl, payload)
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiurl, bytes.NewReader(payload))
 
 	if err != nil {
 		return nil, err
@@ -121,20 +330,22 @@ func (c *APIClient) call(version string, endpoint string, method string, content
 
 	if method != "GET" {
 		req.Header.Add("Content-Type", contentType+"; charset=utf-8")
-		req.Header.Add("Content-Length", strconv.Itoa(payload.Len()))
+		req.Header.Add("Content-Length", strconv.Itoa(len(payload)))
 	}
 
 	req.SetBasicAuth(c.Key, c.Pass)
+
 	resp, err := c.HTTP.Do(req)
 
 	if err != nil {
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+
 	var body string
 
 	if method != "HEAD" {
-		defer resp.Body.Close()
 		bodyBytes, err := ioutil.ReadAll(resp.Body)
 
 		if err != nil {
@@ -144,32 +355,27 @@ func (c *APIClient) call(version string, endpoint string, method string, content
 		body = string(bodyBytes)
 	}
 
-	apiresp := &APIResponse{resp.Header, StatusCode(resp.StatusCode), body}
+	apiresp := &APIResponse{Header: resp.Header, StatusCode: StatusCode(resp.StatusCode), Body: body}
 
 	return apiresp, nil
 }
 
 // GetRepositories returns a list of all repositories owned by `owner`
-func (c *APIClient) GetRepositories(owner string) ([]Repository, error) {
+func (c *APIClient) GetRepositories(ctx context.Context, owner string) ([]Repository, error) {
 	var repos []Repository
 
-	page := 1
-	for {
-		apiresp, err := c.call("2.0", fmt.Sprintf("repositories/%s?page=%d", owner, page), "GET", "", &bytes.Buffer{})
-		if err != nil {
+	pages := c.ListRepositories(ctx, owner, ListOptions{})
+	for pages.Next() {
+		var repo Repository
+		if err := pages.Decode(&repo); err != nil {
 			return []Repository{}, err
 		}
 
-		var reporesp RepositoryResponse
-		json.Unmarshal([]byte(apiresp.Body), &reporesp)
-
-		repos = append(repos, reporesp.Repositories...)
-
-		if page*reporesp.PageLen >= reporesp.Size {
-			break
-		}
+		repos = append(repos, repo)
+	}
 
-		page++
+	if err := pages.Err(); err != nil {
+		return []Repository{}, err
 	}
 
 	return repos, nil
@@ -177,15 +383,15 @@ func (c *APIClient) GetRepositories(owner string) ([]Repository, error) {
 
 // RepositoriesChanged returns whether or not the repositories for an account has changed
 // as well as the latest ETag returned by the web server.
-func (c *APIClient) RepositoriesChanged(owner string, etag string) (bool, string, error) {
-	apiresp, err := c.callFormEnc("2.0", fmt.Sprintf("repositories/%s", owner), "HEAD", nil)
+func (c *APIClient) RepositoriesChanged(ctx context.Context, owner string, etag string) (bool, string, error) {
+	apiresp, err := c.callNoBody(ctx, "2.0", fmt.Sprintf("repositories/%s", owner), "HEAD")
 
 	if err != nil {
 		return false, etag, err
 	}
 
 	if apiresp.StatusCode != 200 {
-		return false, etag, fmt.Errorf("%s", apiresp.Body)
+		return false, etag, newAPIError(apiresp)
 	}
 
 	currentEtag := apiresp.Header.Get("Etag")
@@ -193,8 +399,60 @@ func (c *APIClient) RepositoriesChanged(owner string, etag string) (bool, string
 	return etag != currentEtag, currentEtag, nil
 }
 
-// AddBranchRestriction adds a new branch restriction to a repository
-func (c *APIClient) AddBranchRestriction(owner string, repo string, kind string, branchpattern string, users []string, groups []string) error {
+// GetRepository returns the properties of a single repository
+func (c *APIClient) GetRepository(ctx context.Context, owner string, repo string) (Repository, error) {
+	apiresp, err := c.callNoBody(ctx, "2.0", fmt.Sprintf("repositories/%s/%s", owner, repo), "GET")
+
+	if err != nil {
+		return Repository{}, err
+	}
+
+	if apiresp.StatusCode != 200 {
+		return Repository{}, newAPIError(apiresp)
+	}
+
+	var repository Repository
+	if err := json.Unmarshal([]byte(apiresp.Body), &repository); err != nil {
+		return Repository{}, err
+	}
+
+	return repository, nil
+}
+
+// GetBranchRestrictions returns the branch restrictions on a repository
+func (c *APIClient) GetBranchRestrictions(ctx context.Context, owner string, repo string) ([]BranchRestriction, error) {
+	restrictions := []BranchRestriction{}
+
+	pages := c.paginate(ctx, fmt.Sprintf("repositories/%s/%s/branch-restrictions", owner, repo), ListOptions{})
+	for pages.Next() {
+		var restriction branchRestriction
+		if err := pages.Decode(&restriction); err != nil {
+			return nil, err
+		}
+
+		r := BranchRestriction{ID: restriction.ID, Kind: restriction.Kind, Pattern: restriction.Pattern}
+
+		for _, user := range restriction.Users {
+			r.Users = append(r.Users, user.Username)
+		}
+
+		for _, group := range restriction.Groups {
+			r.Groups = append(r.Groups, group.Slug)
+		}
+
+		restrictions = append(restrictions, r)
+	}
+
+	if err := pages.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+// newBranchRestriction returns a restriction as it is sent to the API. The
+// groups are assumed to be owned by the repository owner.
+func newBranchRestriction(owner string, kind string, branchpattern string, users []string, groups []string) branchRestriction {
 	restriction := branchRestriction{}
 	restriction.Kind = kind
 	restriction.Pattern = branchpattern
@@ -211,7 +469,16 @@ func (c *APIClient) AddBranchRestriction(owner string, repo string, kind string,
 		}
 	}
 
-	apiresp, err := c.callJSONEnc("2.0", fmt.Sprintf("repositories/%s/%s/branch-restrictions", owner, repo), "POST", restriction)
+	return restriction
+}
+
+// AddBranchRestriction adds a new branch restriction to a repository. Adding
+// a restriction that already exists is not an error, but doesn't change its
+// users and groups, use UpdateBranchRestriction for that.
+func (c *APIClient) AddBranchRestriction(ctx context.Context, owner string, repo string, kind string, branchpattern string, users []string, groups []string) error {
+	restriction := newBranchRestriction(owner, kind, branchpattern, users, groups)
+
+	apiresp, err := c.callJSONEnc(ctx, "2.0", fmt.Sprintf("repositories/%s/%s/branch-restrictions", owner, repo), "POST", restriction)
 
 	if err != nil {
 		return err
@@ -221,122 +488,229 @@ func (c *APIClient) AddBranchRestriction(owner string, repo string, kind string,
 		return nil
 	}
 
-	return fmt.Errorf("[%d]: %s", apiresp.StatusCode, apiresp.Body)
+	return newAPIError(apiresp)
 }
 
-// AddUserPrivilege adds a privilege for a user on a repository
-func (c *APIClient) AddUserPrivilege(owner string, repo string, privilegeUser string, privilege string) error {
-	return c.addPrivilege(owner, repo, "privileges", privilegeUser, privilege)
+// UpdateBranchRestriction replaces the users and groups of an existing branch
+// restriction
+func (c *APIClient) UpdateBranchRestriction(ctx context.Context, owner string, repo string, restriction BranchRestriction) error {
+	update := newBranchRestriction(owner, restriction.Kind, restriction.Pattern, restriction.Users, restriction.Groups)
+	update.ID = restriction.ID
+
+	// Empty lists remove all users or groups, while null leaves them as they are
+	if update.Users == nil {
+		update.Users = []restrictionUser{}
+	}
+	if update.Groups == nil {
+		update.Groups = []restrictionGroup{}
+	}
+
+	apiresp, err := c.callJSONEnc(ctx, "2.0", fmt.Sprintf("repositories/%s/%s/branch-restrictions/%d", owner, repo, restriction.ID), "PUT", update)
+
+	if err != nil {
+		return err
+	}
+
+	if apiresp.StatusCode == 200 {
+		return nil
+	}
+
+	return newAPIError(apiresp)
+}
+
+// DeleteBranchRestriction removes a branch restriction from a repository
+func (c *APIClient) DeleteBranchRestriction(ctx context.Context, owner string, repo string, restrictionID int) error {
+	return c.deleteResource(ctx, fmt.Sprintf("repositories/%s/%s/branch-restrictions/%d", owner, repo, restrictionID))
+}
+
+// AddUserPrivilege adds a privilege for a user on a repository. The user is
+// given by the Atlassian account ID, as the API doesn't accept usernames.
+func (c *APIClient) AddUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string, privilege string) error {
+	return c.addPrivilege(ctx, owner, repo, "users", privilegeUser, privilege)
 }
 
-// AddGroupPrivilege adds a privilege for a group on a repository
-func (c *APIClient) AddGroupPrivilege(owner string, repo string, privilegeGroup string, privilege string) error {
-	group := fmt.Sprintf("%s/%s", owner, privilegeGroup)
-	return c.addPrivilege(owner, repo, "group-privileges", group, privilege)
+// AddGroupPrivilege adds a privilege for a group on a repository. The group
+// is assumed to be owned by the repository owner.
+func (c *APIClient) AddGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string, privilege string) error {
+	return c.addPrivilege(ctx, owner, repo, "groups", privilegeGroup, privilege)
 }
 
-func (c *APIClient) addPrivilege(owner string, repo string, privilegeURL string, privilegeEntity string, privilege string) error {
-	endpoint := fmt.Sprintf("%s/%s/%s/%s", privilegeURL, owner, repo, privilegeEntity)
+func (c *APIClient) addPrivilege(ctx context.Context, owner string, repo string, entityType string, privilegeEntity string, privilege string) error {
+	endpoint := fmt.Sprintf("repositories/%s/%s/permissions-config/%s/%s", owner, repo, entityType, privilegeEntity)
 
 	if !(privilege == "read" || privilege == "write" || privilege == "admin") {
 		return fmt.Errorf("Wrong privilege ('%s'). One of 'read', 'write' or 'admin' required.", privilege)
 	}
 
-	apiresp, err := c.callStringBody("1.0", endpoint, "PUT", privilege)
+	apiresp, err := c.callJSONEnc(ctx, "2.0", endpoint, "PUT", permission{privilege})
 
 	if err != nil {
 		return err
 	}
 
-	if apiresp.StatusCode == 200 {
+	if apiresp.StatusCode == 200 || apiresp.StatusCode == 201 {
 		return nil
 	}
 
-	return fmt.Errorf("[%d]: %s", apiresp.StatusCode, apiresp.Body)
+	return newAPIError(apiresp)
+}
+
+// GetUserPrivileges returns the explicit user privileges on a repository as
+// a map of Atlassian account IDs to privileges
+func (c *APIClient) GetUserPrivileges(ctx context.Context, owner string, repo string) (map[string]string, error) {
+	return c.getPrivileges(ctx, owner, repo, "users")
 }
 
-// GetServices returns a list of the service hooks attached to a repository
-func (c *APIClient) GetServices(owner string, repository string) ([]Service, error) {
-	resp, err := c.callFormEnc("1.0", fmt.Sprintf("repositories/%s/%s/services", owner, repository), "GET", nil)
+// GetGroupPrivileges returns the explicit group privileges on a repository as
+// a map of group names to privileges
+func (c *APIClient) GetGroupPrivileges(ctx context.Context, owner string, repo string) (map[string]string, error) {
+	return c.getPrivileges(ctx, owner, repo, "groups")
+}
 
-	if err != nil {
-		return nil, err
+func (c *APIClient) getPrivileges(ctx context.Context, owner string, repo string, entityType string) (map[string]string, error) {
+	privileges := make(map[string]string)
+
+	pages := c.paginate(ctx, fmt.Sprintf("repositories/%s/%s/permissions-config/%s", owner, repo, entityType), ListOptions{})
+	for pages.Next() {
+		var perm entityPermission
+		if err := pages.Decode(&perm); err != nil {
+			return nil, err
+		}
+
+		if entityType == "users" {
+			privileges[perm.User.AccountID] = perm.Permission
+		} else {
+			privileges[perm.Group.Slug] = perm.Permission
+		}
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("[%d]: %s", resp.StatusCode, resp.Body)
+	if err := pages.Err(); err != nil {
+		return nil, err
 	}
 
-	var serviceResponse []Service
+	return privileges, nil
+}
 
-	json.Unmarshal([]byte(resp.Body), &serviceResponse)
+// DeleteUserPrivilege removes the explicit privilege of a user, given by the
+// Atlassian account ID, on a repository
+func (c *APIClient) DeleteUserPrivilege(ctx context.Context, owner string, repo string, privilegeUser string) error {
+	return c.deleteResource(ctx, fmt.Sprintf("repositories/%s/%s/permissions-config/users/%s", owner, repo, privilegeUser))
+}
 
-	return serviceResponse, nil
+// DeleteGroupPrivilege removes the explicit privilege of a group on a repository
+func (c *APIClient) DeleteGroupPrivilege(ctx context.Context, owner string, repo string, privilegeGroup string) error {
+	return c.deleteResource(ctx, fmt.Sprintf("repositories/%s/%s/permissions-config/groups/%s", owner, repo, privilegeGroup))
 }
 
-// AddService attaches a new service hook to the repository
-func (c *APIClient) AddService(owner string, repository string, servicetype string, parameters map[string]string) error {
-	data := url.Values{}
-	data.Set("type", servicetype)
+// GetServices returns a list of the webhooks attached to a repository. The
+// webhooks are returned as POST services with a single URL field.
+func (c *APIClient) GetServices(ctx context.Context, owner string, repository string) ([]Service, error) {
+	services := []Service{}
+
+	pages := c.paginate(ctx, fmt.Sprintf("repositories/%s/%s/hooks", owner, repository), ListOptions{})
+	for pages.Next() {
+		var hook webhook
+		if err := pages.Decode(&hook); err != nil {
+			return nil, err
+		}
+
+		service := Service{UUID: hook.UUID}
+		service.Service.Type = "POST"
+		service.Service.Fields = []ServiceField{{"URL", hook.URL}}
+
+		services = append(services, service)
+	}
+
+	if err := pages.Err(); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
 
-	for key, value := range parameters {
-		data.Set(key, value)
+// AddService attaches a new webhook to the repository. Only "POST" services
+// are supported, and the "URL" parameter is used as the webhook URL.
+func (c *APIClient) AddService(ctx context.Context, owner string, repository string, servicetype string, parameters map[string]string) error {
+	if servicetype != "POST" {
+		return fmt.Errorf("Unsupported service type ('%s'). Only 'POST' is supported.", servicetype)
 	}
 
-	resp, err := c.callFormEnc("1.0", fmt.Sprintf("repositories/%s/%s/services", owner, repository), "POST", data)
+	hook := webhook{}
+	hook.URL = parameters["URL"]
+	hook.Description = "bitbucket-enforcer"
+	hook.Active = true
+	hook.Events = []string{"repo:push"}
+
+	resp, err := c.callJSONEnc(ctx, "2.0", fmt.Sprintf("repositories/%s/%s/hooks", owner, repository), "POST", hook)
 
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode == 200 {
+	if resp.StatusCode == 200 || resp.StatusCode == 201 {
 		return nil
 	}
 
-	return fmt.Errorf("[%d]: %s", resp.StatusCode, resp.Body)
+	return newAPIError(resp)
 }
 
-// GetDeployKeys returns a list of all deploy keys attached to a repository
-func (c *APIClient) GetDeployKeys(owner string, repo string) ([]DeployKey, error) {
-	apiresp, err := c.callFormEnc("1.0", fmt.Sprintf("repositories/%s/%s/deploy-keys", owner, repo), "GET", nil)
+// DeleteService removes a webhook from the repository
+func (c *APIClient) DeleteService(ctx context.Context, owner string, repository string, serviceUUID string) error {
+	return c.deleteResource(ctx, fmt.Sprintf("repositories/%s/%s/hooks/%s", owner, repository, serviceUUID))
+}
 
-	if err != nil {
-		return nil, err
-	}
+// GetDeployKeys returns a list of all deploy keys attached to a repository.
+// The key comment is appended to the key, as it is in the public key file.
+func (c *APIClient) GetDeployKeys(ctx context.Context, owner string, repo string) ([]DeployKey, error) {
+	keys := []DeployKey{}
 
-	if apiresp.StatusCode != 200 {
-		return nil, fmt.Errorf("%s", apiresp.Body)
-	}
+	pages := c.paginate(ctx, fmt.Sprintf("repositories/%s/%s/deploy-keys", owner, repo), ListOptions{})
+	for pages.Next() {
+		var key DeployKey
+		if err := pages.Decode(&key); err != nil {
+			return nil, err
+		}
 
-	var keys []DeployKey
+		if key.Comment != "" {
+			key.Key = fmt.Sprintf("%s %s", key.Key, key.Comment)
+		}
+
+		keys = append(keys, key)
+	}
 
-	json.Unmarshal([]byte(apiresp.Body), &keys)
+	if err := pages.Err(); err != nil {
+		return nil, err
+	}
 
 	return keys, nil
 }
 
 // AddDeployKey attaches a new deploy key to a repository
-func (c *APIClient) AddDeployKey(owner string, repository string, name string, key string) error {
-	data := url.Values{}
-	data.Set("label", name)
-	data.Set("key", key)
+func (c *APIClient) AddDeployKey(ctx context.Context, owner string, repository string, name string, key string) error {
+	data := make(map[string]string)
+	data["label"] = name
+	data["key"] = key
 
-	resp, err := c.callFormEnc("1.0", fmt.Sprintf("repositories/%s/%s/deploy-keys", owner, repository), "POST", data)
+	resp, err := c.callJSONEnc(ctx, "2.0", fmt.Sprintf("repositories/%s/%s/deploy-keys", owner, repository), "POST", data)
 
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode == 200 {
+	if resp.StatusCode == 200 || resp.StatusCode == 201 {
 		return nil
 	}
 
-	return fmt.Errorf("[%d]: %s", resp.StatusCode, resp.Body)
+	return newAPIError(resp)
 }
 
 // DeleteDeployKey removes a deploy key from a repository
-func (c *APIClient) DeleteDeployKey(owner string, repository string, keyID int) error {
-	resp, err := c.callFormEnc("1.0", fmt.Sprintf("repositories/%s/%s/deploy-keys/%d", owner, repository, keyID), "DELETE", nil)
+func (c *APIClient) DeleteDeployKey(ctx context.Context, owner string, repository string, keyID int) error {
+	return c.deleteResource(ctx, fmt.Sprintf("repositories/%s/%s/deploy-keys/%d", owner, repository, keyID))
+}
+
+func (c *APIClient) deleteResource(ctx context.Context, endpoint string) error {
+	resp, err := c.callNoBody(ctx, "2.0", endpoint, "DELETE")
 
 	if err != nil {
 		return err
@@ -346,12 +720,12 @@ func (c *APIClient) DeleteDeployKey(owner string, repository string, keyID int)
 		return nil
 	}
 
-	return fmt.Errorf("[%d]: %s", resp.StatusCode, resp.Body)
+	return newAPIError(resp)
 }
 
 // Used when updating properties on repositories
-func (c *APIClient) putV2RepoProp(owner string, repository string, data interface{}) (*APIResponse, error) {
-	return c.callJSONEnc("2.0", fmt.Sprintf("repositories/%s/%s", owner, repository), "PUT", data)
+func (c *APIClient) putV2RepoProp(ctx context.Context, owner string, repository string, data interface{}) (*APIResponse, error) {
+	return c.callJSONEnc(ctx, "2.0", fmt.Sprintf("repositories/%s/%s", owner, repository), "PUT", data)
 }
 
 func (c *APIClient) getV2Error(resp *APIResponse, err error) error {
@@ -363,51 +737,39 @@ func (c *APIClient) getV2Error(resp *APIResponse, err error) error {
 		return nil
 	}
 
-	return fmt.Errorf("[%d]: %s", resp.StatusCode, resp.Body)
-}
-
-func (c *APIClient) getV1Error(resp *APIResponse, err error) error {
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode == 200 {
-		return nil
-	}
-
-	return fmt.Errorf("[%d]: %s", resp.StatusCode, resp.Body)
+	return newAPIError(resp)
 }
 
 // SetPrivacy set the repository privacy/visibility
-func (c *APIClient) SetPrivacy(owner string, repository string, isPrivate bool) error {
+func (c *APIClient) SetPrivacy(ctx context.Context, owner string, repository string, isPrivate bool) error {
 	props := make(map[string]bool)
 	props["is_private"] = isPrivate
 
-	res, err := c.putV2RepoProp(owner, repository, props)
+	res, err := c.putV2RepoProp(ctx, owner, repository, props)
 	return c.getV2Error(res, err)
 }
 
 // SetIssueTracker sets whether the repository has PUBLIC or NO issue tracker
 // (Private issue trackers doesn't seem to be supported by the API)
-func (c *APIClient) SetIssueTracker(owner string, repository string, issueTracker bool) error {
+func (c *APIClient) SetIssueTracker(ctx context.Context, owner string, repository string, issueTracker bool) error {
 	props := make(map[string]bool)
 	props["has_issues"] = issueTracker
 
-	res, err := c.putV2RepoProp(owner, repository, props)
+	res, err := c.putV2RepoProp(ctx, owner, repository, props)
 	return c.getV2Error(res, err)
 }
 
 // SetDescription sets the main branch for the repository
-func (c *APIClient) SetDescription(owner string, repository string, description string) error {
+func (c *APIClient) SetDescription(ctx context.Context, owner string, repository string, description string) error {
 	props := make(map[string]string)
 	props["description"] = description
 
-	res, err := c.putV2RepoProp(owner, repository, props)
+	res, err := c.putV2RepoProp(ctx, owner, repository, props)
 	return c.getV2Error(res, err)
 }
 
 // SetForks set the forking policy for the repository: "none", "private" or "public"
-func (c *APIClient) SetForks(owner string, repository string, forks string) error {
+func (c *APIClient) SetForks(ctx context.Context, owner string, repository string, forks string) error {
 	props := make(map[string]string)
 
 	if forks == "none" {
@@ -416,8 +778,40 @@ func (c *APIClient) SetForks(owner string, repository string, forks string) erro
 		props["fork_policy"] = "no_public_forks"
 	} else if forks == "public" {
 		props["fork_policy"] = "allow_forks"
+	} else {
+		return fmt.Errorf("Wrong fork policy ('%s'). One of 'none', 'private' or 'public' required.", forks)
 	}
 
-	res, err := c.putV2RepoProp(owner, repository, props)
+	res, err := c.putV2RepoProp(ctx, owner, repository, props)
 	return c.getV2Error(res, err)
 }
+
+// CurrentUser returns the account the client is authenticated as. The account
+// of a client doesn't change, so it is only requested once.
+func (c *APIClient) CurrentUser(ctx context.Context) (User, error) {
+	c.userMu.Lock()
+	defer c.userMu.Unlock()
+
+	if c.user != nil {
+		return *c.user, nil
+	}
+
+	apiresp, err := c.callNoBody(ctx, "2.0", "user", "GET")
+
+	if err != nil {
+		return User{}, err
+	}
+
+	if apiresp.StatusCode != 200 {
+		return User{}, newAPIError(apiresp)
+	}
+
+	var user User
+	if err := json.Unmarshal([]byte(apiresp.Body), &user); err != nil {
+		return User{}, err
+	}
+
+	c.user = &user
+
+	return user, nil
+}
@@ -0,0 +1,44 @@
+package gobucket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetRepositoryInvalidJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body>Maintenance</body></html>`))
+	}))
+	defer server.Close()
+
+	client := New("user", "secret")
+	client.BaseURL = server.URL
+
+	if _, err := client.GetRepository(context.Background(), "acme", "api"); err == nil {
+		t.Error("expected an error for a response that isn't a repository")
+	}
+}
+
+func TestSetForks(t *testing.T) {
+	client, requests := testClient(t)
+
+	for _, forks := range []string{"none", "private", "public"} {
+		if err := client.SetForks(context.Background(), "acme", "api", forks); err != nil {
+			t.Errorf("%s: %s", forks, err)
+		}
+	}
+
+	before := atomic.LoadInt32(requests)
+	for _, forks := range []string{"", "everyone", "None"} {
+		if err := client.SetForks(context.Background(), "acme", "api", forks); err == nil {
+			t.Errorf("'%s': expected an error for an unknown fork policy", forks)
+		}
+	}
+
+	if atomic.LoadInt32(requests) != before {
+		t.Error("expected no requests for unknown fork policies")
+	}
+}
@@ -0,0 +1,190 @@
+package gobucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MaxPageLen is the largest page size accepted by the 2.0 API
+const MaxPageLen = 100
+
+// ListOptions filters and sorts the results of a list endpoint. See
+// https://developer.atlassian.com/cloud/bitbucket/rest/intro/#filtering for
+// the query and sort syntax.
+type ListOptions struct {
+	Query   string // q=, e.g. `name ~ "api"`
+	Sort    string // sort=, e.g. "-updated_on"
+	PageLen int    // pagelen=, MaxPageLen if 0
+}
+
+func (o ListOptions) encode() string {
+	params := url.Values{}
+
+	if o.Query != "" {
+		params.Set("q", o.Query)
+	}
+
+	if o.Sort != "" {
+		params.Set("sort", o.Sort)
+	}
+
+	pagelen := o.PageLen
+	if pagelen <= 0 || pagelen > MaxPageLen {
+		pagelen = MaxPageLen
+	}
+	params.Set("pagelen", strconv.Itoa(pagelen))
+
+	return params.Encode()
+}
+
+// listPage is a single page of a 2.0 list response
+type listPage struct {
+	Values []json.RawMessage `json:"values"`
+	Next   string            `json:"next"`
+}
+
+/*
+Paginator iterates over the values of a 2.0 list endpoint, fetching a page at
+a time by following the 'next' links in the responses. A link to another host
+than BaseURL stops the iteration with an error, so the credentials are never
+sent elsewhere:
+
+	pages := client.ListRepositories(ctx, owner, gobucket.ListOptions{})
+	for pages.Next() {
+		var repo gobucket.Repository
+		if err := pages.Decode(&repo); err != nil { ... }
+	}
+	if err := pages.Err(); err != nil { ... }
+*/
+type Paginator struct {
+	c       *APIClient
+	ctx     context.Context
+	next    string
+	values  []json.RawMessage
+	current json.RawMessage
+	err     error
+}
+
+func (c *APIClient) paginate(ctx context.Context, endpoint string, opts ListOptions) *Paginator {
+	return &Paginator{
+		c:    c,
+		ctx:  ctx,
+		next: fmt.Sprintf("%s?%s", c.url("2.0", endpoint), opts.encode()),
+	}
+}
+
+// Next advances to the next value, fetching the next page if needed. It
+// returns false when there are no more values or an error occurred.
+func (p *Paginator) Next() bool {
+	for len(p.values) == 0 {
+		if p.err != nil || p.next == "" {
+			return false
+		}
+
+		p.fetch()
+	}
+
+	p.current, p.values = p.values[0], p.values[1:]
+
+	return true
+}
+
+func (p *Paginator) fetch() {
+	apiresp, err := p.c.do(p.ctx, p.next, "GET", "", nil)
+	if err != nil {
+		p.err = err
+		return
+	}
+
+	if apiresp.StatusCode != 200 {
+		p.err = newAPIError(apiresp)
+		return
+	}
+
+	var page listPage
+	if err := json.Unmarshal([]byte(apiresp.Body), &page); err != nil {
+		p.err = err
+		return
+	}
+
+	p.values = page.Values
+	p.next = page.Next
+
+	if p.next != "" && !p.c.sameHost(p.next) {
+		p.err = fmt.Errorf("Refusing to fetch the next page from another host ('%s')", p.next)
+		p.next = ""
+	}
+}
+
+// sameHost reports whether a URL has the scheme and host of BaseURL
+func (c *APIClient) sameHost(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return false
+	}
+
+	return u.Scheme == base.Scheme && strings.EqualFold(u.Host, base.Host)
+}
+
+// Decode unmarshals the current value into v
+func (p *Paginator) Decode(v interface{}) error {
+	return json.Unmarshal(p.current, v)
+}
+
+// Err returns the error that stopped the iteration, if any
+func (p *Paginator) Err() error {
+	return p.err
+}
+
+// ListRepositories returns a Paginator over the repositories owned by
+// `owner` that match the options
+func (c *APIClient) ListRepositories(ctx context.Context, owner string, opts ListOptions) *Paginator {
+	return c.paginate(ctx, fmt.Sprintf("repositories/%s", owner), opts)
+}
+
+/*
+Streams the repositories owned by `owner` that match the options. Pages are
+fetched as the channel is read. The error channel receives the error that
+stopped the listing, if any, and is closed when the listing is done. Cancel
+ctx to stop early.
+*/
+func (c *APIClient) StreamRepositories(ctx context.Context, owner string, opts ListOptions) (<-chan Repository, <-chan error) {
+	repos := make(chan Repository)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(repos)
+
+		pages := c.ListRepositories(ctx, owner, opts)
+		for pages.Next() {
+			var repo Repository
+			if err := pages.Decode(&repo); err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case repos <- repo:
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			}
+		}
+
+		if err := pages.Err(); err != nil {
+			errs <- err
+		}
+	}()
+
+	return repos, errs
+}
@@ -0,0 +1,61 @@
+package gobucket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPaginatorNextHost(t *testing.T) {
+	var foreignRequests int32
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&foreignRequests, 1)
+		w.Write([]byte(`{"values": [{"full_name": "evil/repo"}]}`))
+	}))
+	defer foreign.Close()
+
+	var next string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprint(w, `{"values": [{"full_name": "acme/web"}]}`)
+			return
+		}
+
+		fmt.Fprintf(w, `{"values": [{"full_name": "acme/api"}], "next": %q}`, next)
+	}))
+	defer server.Close()
+
+	client := New("user", "secret")
+	client.BaseURL = server.URL
+
+	tests := []struct {
+		next     string
+		expected int
+		valid    bool
+	}{
+		{server.URL + "/2.0/repositories/acme?page=2", 2, true},
+		{foreign.URL + "/2.0/repositories/acme?page=2", 1, false},
+		{"/2.0/repositories/acme?page=2", 1, false},
+	}
+
+	for _, test := range tests {
+		next = test.next
+
+		var repos int
+		pages := client.ListRepositories(context.Background(), "acme", ListOptions{})
+		for pages.Next() {
+			repos++
+		}
+
+		if repos != test.expected || (pages.Err() == nil) != test.valid {
+			t.Errorf("%s: expected %d repositories and valid %v, got %d and %v", test.next, test.expected, test.valid, repos, pages.Err())
+		}
+	}
+
+	if atomic.LoadInt32(&foreignRequests) != 0 {
+		t.Error("a page was fetched from another host")
+	}
+}
@@ -0,0 +1,112 @@
+package gobucket
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sleep waits for the duration, or until the context is done. It is replaced
+// in tests.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RetryCount returns the total number of retried requests made by the client
+func (c *APIClient) RetryCount() int64 {
+	return atomic.LoadInt64(&c.retries)
+}
+
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "PUT" || method == "DELETE"
+}
+
+/*
+Decides whether a request should be retried. Rate limited requests (429) are
+always retried, as they haven't been processed. Network errors and server
+errors are only retried for idempotent methods, as a POST may already have
+taken effect.
+*/
+func shouldRetry(method string, resp *APIResponse, err error) (bool, string) {
+	if err != nil {
+		return idempotent(method), err.Error()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true, "rate limited"
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(method), fmt.Sprintf("server error %d", resp.StatusCode)
+	}
+
+	return false, ""
+}
+
+/*
+Returns the delay before the next attempt. A delay requested by the API in a
+Retry-After or X-RateLimit-Reset header is honoured. Otherwise the delay grows
+exponentially with the attempt, with random jitter so parallel requests don't
+retry in lockstep.
+*/
+func (c *APIClient) retryDelay(attempt int, resp *APIResponse) time.Duration {
+	if resp != nil {
+		if delay, ok := requestedDelay(resp.Header, time.Now()); ok {
+			if c.MaxRetryDelay > 0 && delay > c.MaxRetryDelay {
+				return c.MaxRetryDelay
+			}
+			return delay
+		}
+	}
+
+	delay := c.RetryDelay << uint(attempt)
+	if delay <= 0 || (c.MaxRetryDelay > 0 && delay > c.MaxRetryDelay) {
+		delay = c.MaxRetryDelay
+	}
+
+	// Full jitter in the upper half of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// requestedDelay reads the delay requested by the API from the headers
+func requestedDelay(header http.Header, now time.Time) (time.Duration, bool) {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			if date.Before(now) {
+				return 0, true
+			}
+			return date.Sub(now), true
+		}
+	}
+
+	if reset := header.Get("X-RateLimit-Reset"); reset != "" {
+		if epoch, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			resetTime := time.Unix(epoch, 0)
+			if resetTime.Before(now) {
+				return 0, true
+			}
+			return resetTime.Sub(now), true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package gobucket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordSleeps replaces sleep with a function that records the delays instead
+// of waiting
+func recordSleeps(t *testing.T) *[]time.Duration {
+	var delays []time.Duration
+
+	original := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return ctx.Err()
+	}
+	t.Cleanup(func() { sleep = original })
+
+	return &delays
+}
+
+// testClient returns a client for a server that responds with the given
+// status codes in turn, and then with 200 and a repository
+func testClient(t *testing.T, statusCodes ...int) (*APIClient, *int32) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&requests, 1))
+		if n <= len(statusCodes) {
+			if statusCodes[n-1] == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "7")
+			}
+			w.WriteHeader(statusCodes[n-1])
+			return
+		}
+
+		w.Write([]byte(`{"full_name": "acme/api", "is_private": true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	client := New("user", "secret")
+	client.BaseURL = server.URL
+
+	return client, &requests
+}
+
+func TestRetryAfter(t *testing.T) {
+	delays := recordSleeps(t)
+	client, requests := testClient(t, http.StatusTooManyRequests)
+
+	repo, err := client.GetRepository(context.Background(), "acme", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !repo.IsPrivate || atomic.LoadInt32(requests) != 2 || client.RetryCount() != 1 {
+		t.Fatalf("expected one retry, got %d requests and %d retries", atomic.LoadInt32(requests), client.RetryCount())
+	}
+	if len(*delays) != 1 || (*delays)[0] != 7*time.Second {
+		t.Errorf("expected a delay of 7s from Retry-After, got %v", *delays)
+	}
+}
+
+func TestServerErrorBackoff(t *testing.T) {
+	delays := recordSleeps(t)
+	client, _ := testClient(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+
+	if _, err := client.GetRepository(context.Background(), "acme", "api"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*delays) != 2 {
+		t.Fatalf("expected two retries, got delays %v", *delays)
+	}
+
+	// RetryDelay doubles with each attempt, with jitter in its upper half
+	for attempt, delay := range *delays {
+		max := client.RetryDelay << uint(attempt)
+		if delay < max/2 || delay > max {
+			t.Errorf("delay %d is %v, expected between %v and %v", attempt, delay, max/2, max)
+		}
+	}
+}
+
+func TestServerErrorOnPostNotRetried(t *testing.T) {
+	delays := recordSleeps(t)
+	client, requests := testClient(t, http.StatusServiceUnavailable)
+
+	err := client.AddDeployKey(context.Background(), "acme", "api", "ci", "ssh-ed25519 AAAA")
+	if err == nil {
+		t.Fatal("expected the server error to be returned")
+	}
+
+	if atomic.LoadInt32(requests) != 1 || len(*delays) != 0 {
+		t.Errorf("expected a single request, got %d requests and delays %v", atomic.LoadInt32(requests), *delays)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	delays := recordSleeps(t)
+	client, requests := testClient(t, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests)
+	client.MaxRetries = 2
+
+	_, err := client.GetRepository(context.Background(), "acme", "api")
+	if !IsRateLimited(err) {
+		t.Fatalf("expected a rate limit error, got %v", err)
+	}
+
+	if atomic.LoadInt32(requests) != 3 || len(*delays) != 2 || client.RetryCount() != 2 {
+		t.Errorf("expected 3 requests and 2 retries, got %d requests and %d retries", atomic.LoadInt32(requests), client.RetryCount())
+	}
+}
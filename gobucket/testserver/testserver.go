@@ -0,0 +1,530 @@
+// Package testserver provides a local HTTP stand-in for the subset of the
+// BitBucket 2.0 API used by gobucket. Repository state is kept in a
+// fake.Client, so tests can set up and inspect repositories directly.
+package testserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+	"github.com/jumoel/bitbucket-enforcer/gobucket/fake"
+)
+
+// DefaultPageLen is the maximum number of values returned per page
+const DefaultPageLen = 10
+
+// Server is a running BitBucket stand-in
+type Server struct {
+	*httptest.Server
+
+	Bitbucket *fake.Client
+	PageLen   int
+	Username  string
+	Password  string
+}
+
+var forkPolicies = map[string]string{
+	"no_forks":        "none",
+	"no_public_forks": "private",
+	"allow_forks":     "public",
+}
+
+// New starts a server backed by bb. If bb is nil, an empty fake is used.
+// Basic auth is only checked when Username is set.
+func New(bb *fake.Client) *Server {
+	if bb == nil {
+		bb = fake.New()
+	}
+
+	s := &Server{Bitbucket: bb, PageLen: DefaultPageLen}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Client returns an API client that talks to the server
+func (s *Server) Client() *gobucket.APIClient {
+	client := gobucket.New(s.Username, s.Password)
+	client.BaseURL = s.URL
+	client.HTTP = s.Server.Client()
+
+	return client
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Username != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != s.Username || pass != s.Password {
+			writeError(w, http.StatusUnauthorized, "Invalid credentials")
+			return
+		}
+	}
+
+	if r.URL.Path == "/2.0/user" && r.Method == "GET" {
+		user, _ := s.Bitbucket.CurrentUser(r.Context())
+		writeJSON(w, http.StatusOK, user)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/2.0/repositories"), "/")
+	if path == r.URL.Path || path == "" {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+
+	parts := strings.Split(path, "/")
+
+	if len(parts) == 1 {
+		s.listRepositories(w, r, parts[0])
+		return
+	}
+
+	owner, slug := parts[0], parts[1]
+	if s.Bitbucket.Repository(owner, slug) == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Repository %s/%s not found", owner, slug))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == "GET":
+		repo, _ := s.Bitbucket.GetRepository(r.Context(), owner, slug)
+		writeJSON(w, http.StatusOK, repo)
+	case len(parts) == 2:
+		s.updateRepository(w, r, owner, slug)
+	case parts[2] == "branch-restrictions" && len(parts) == 3:
+		s.branchRestrictions(w, r, owner, slug)
+	case parts[2] == "branch-restrictions" && len(parts) == 4:
+		s.branchRestriction(w, r, owner, slug, parts[3])
+	case parts[2] == "deploy-keys" && len(parts) <= 4:
+		s.deployKeys(w, r, owner, slug, parts[3:])
+	case parts[2] == "hooks" && len(parts) == 3:
+		s.hooks(w, r, owner, slug)
+	case parts[2] == "hooks" && len(parts) == 4 && r.Method == "DELETE":
+		writeDeleted(w, s.Bitbucket.DeleteService(r.Context(), owner, slug, parts[3]))
+	case parts[2] == "permissions-config" && len(parts) == 4:
+		s.listPermissions(w, r, owner, slug, parts[3])
+	case parts[2] == "permissions-config" && len(parts) == 5:
+		s.permissions(w, r, owner, slug, parts[3], parts[4])
+	default:
+		writeError(w, http.StatusNotFound, "Resource not found")
+	}
+}
+
+func (s *Server) listRepositories(w http.ResponseWriter, r *http.Request, owner string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	_, etag, _ := s.Bitbucket.RepositoriesChanged(r.Context(), owner, "")
+	w.Header().Set("ETag", etag)
+
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	repos, _ := s.Bitbucket.GetRepositories(r.Context(), owner)
+	if repos == nil {
+		repos = []gobucket.Repository{}
+	}
+
+	s.writePage(w, r, repos)
+}
+
+/*
+Writes a page of a list response like the 2.0 API does. The page is selected
+with the 'page' parameter and holds 'pagelen' values, but no more than
+PageLen. If there are more values, the response links to the next page.
+*/
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, values interface{}) {
+	all := reflect.ValueOf(values)
+
+	pagelen := s.PageLen
+	if n, err := strconv.Atoi(r.URL.Query().Get("pagelen")); err == nil && n > 0 && n < pagelen {
+		pagelen = n
+	}
+
+	page := 1
+	if n, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && n > 0 {
+		page = n
+	}
+
+	start := (page - 1) * pagelen
+	if start > all.Len() {
+		start = all.Len()
+	}
+	end := start + pagelen
+	if end > all.Len() {
+		end = all.Len()
+	}
+
+	resp := map[string]interface{}{
+		"pagelen": pagelen,
+		"size":    all.Len(),
+		"page":    page,
+		"values":  all.Slice(start, end).Interface(),
+	}
+
+	if end < all.Len() {
+		next := *r.URL
+		next.Scheme = "http"
+		next.Host = r.Host
+		query := next.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		next.RawQuery = query.Encode()
+		resp["next"] = next.String()
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) updateRepository(w http.ResponseWriter, r *http.Request, owner string, slug string) {
+	if r.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var props struct {
+		IsPrivate   *bool   `json:"is_private"`
+		HasIssues   *bool   `json:"has_issues"`
+		Description *string `json:"description"`
+		ForkPolicy  *string `json:"fork_policy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&props); err != nil {
+		writeClientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var err error
+	if props.IsPrivate != nil && err == nil {
+		err = s.Bitbucket.SetPrivacy(r.Context(), owner, slug, *props.IsPrivate)
+	}
+	if props.HasIssues != nil && err == nil {
+		err = s.Bitbucket.SetIssueTracker(r.Context(), owner, slug, *props.HasIssues)
+	}
+	if props.Description != nil && err == nil {
+		err = s.Bitbucket.SetDescription(r.Context(), owner, slug, *props.Description)
+	}
+	if props.ForkPolicy != nil && err == nil {
+		err = s.Bitbucket.SetForks(r.Context(), owner, slug, forkPolicies[*props.ForkPolicy])
+	}
+
+	if err != nil {
+		writeClientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"full_name": fmt.Sprintf("%s/%s", owner, slug)})
+}
+
+type restrictionUser struct {
+	Username string `json:"username"`
+}
+
+type restrictionGroup struct {
+	Slug string `json:"slug"`
+}
+
+type restriction struct {
+	ID      int                `json:"id"`
+	Kind    string             `json:"kind"`
+	Pattern string             `json:"pattern"`
+	Users   []restrictionUser  `json:"users"`
+	Groups  []restrictionGroup `json:"groups"`
+}
+
+// members returns the usernames and group slugs of a restriction
+func (r restriction) members() ([]string, []string) {
+	var users, groups []string
+	for _, user := range r.Users {
+		users = append(users, user.Username)
+	}
+	for _, group := range r.Groups {
+		groups = append(groups, group.Slug)
+	}
+
+	return users, groups
+}
+
+func (s *Server) branchRestrictions(w http.ResponseWriter, r *http.Request, owner string, slug string) {
+	if r.Method == "GET" {
+		restrictions, _ := s.Bitbucket.GetBranchRestrictions(r.Context(), owner, slug)
+
+		values := []restriction{}
+		for _, stored := range restrictions {
+			value := restriction{ID: stored.ID, Kind: stored.Kind, Pattern: stored.Pattern}
+			for _, user := range stored.Users {
+				value.Users = append(value.Users, restrictionUser{user})
+			}
+			for _, group := range stored.Groups {
+				value.Groups = append(value.Groups, restrictionGroup{group})
+			}
+			values = append(values, value)
+		}
+
+		s.writePage(w, r, values)
+		return
+	}
+
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var posted restriction
+	if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+		writeClientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	users, groups := posted.members()
+	if err := s.Bitbucket.AddBranchRestriction(r.Context(), owner, slug, posted.Kind, posted.Pattern, users, groups); err != nil {
+		writeClientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, posted)
+}
+
+func (s *Server) branchRestriction(w http.ResponseWriter, r *http.Request, owner string, slug string, restrictionID string) {
+	id, err := strconv.Atoi(restrictionID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Branch restriction not found")
+		return
+	}
+
+	switch r.Method {
+	case "DELETE":
+		writeDeleted(w, s.Bitbucket.DeleteBranchRestriction(r.Context(), owner, slug, id))
+	case "PUT":
+		var updated restriction
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			writeClientError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		users, groups := updated.members()
+		stored := gobucket.BranchRestriction{ID: id, Kind: updated.Kind, Pattern: updated.Pattern, Users: users, Groups: groups}
+		if err := s.Bitbucket.UpdateBranchRestriction(r.Context(), owner, slug, stored); err != nil {
+			writeClientError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		updated.ID = id
+		writeJSON(w, http.StatusOK, updated)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) deployKeys(w http.ResponseWriter, r *http.Request, owner string, slug string, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == "GET":
+		keys, _ := s.Bitbucket.GetDeployKeys(r.Context(), owner, slug)
+		if keys == nil {
+			keys = []gobucket.DeployKey{}
+		}
+		s.writePage(w, r, keys)
+
+	case len(rest) == 0 && r.Method == "POST":
+		var key struct {
+			Key   string `json:"key"`
+			Label string `json:"label"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+			writeClientError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := s.Bitbucket.AddDeployKey(r.Context(), owner, slug, key.Label, key.Key); err != nil {
+			writeClientError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, key)
+
+	case len(rest) == 1 && r.Method == "DELETE":
+		id, err := strconv.Atoi(rest[0])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "Deploy key not found")
+			return
+		}
+
+		writeDeleted(w, s.Bitbucket.DeleteDeployKey(r.Context(), owner, slug, id))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) hooks(w http.ResponseWriter, r *http.Request, owner string, slug string) {
+	type webhook struct {
+		UUID        string   `json:"uuid"`
+		URL         string   `json:"url"`
+		Description string   `json:"description"`
+		Active      bool     `json:"active"`
+		Events      []string `json:"events"`
+	}
+
+	switch r.Method {
+	case "GET":
+		services, _ := s.Bitbucket.GetServices(r.Context(), owner, slug)
+
+		hooks := []webhook{}
+		for _, service := range services {
+			hook := webhook{UUID: service.UUID, Active: true, Events: []string{"repo:push"}}
+			for _, field := range service.Service.Fields {
+				if field.Name == "URL" {
+					hook.URL = field.Value
+				}
+			}
+			hooks = append(hooks, hook)
+		}
+
+		s.writePage(w, r, hooks)
+
+	case "POST":
+		var hook webhook
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			writeClientError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := s.Bitbucket.AddService(r.Context(), owner, slug, "POST", map[string]string{"URL": hook.URL}); err != nil {
+			writeClientError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, hook)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (s *Server) listPermissions(w http.ResponseWriter, r *http.Request, owner string, slug string, entityType string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var privileges map[string]string
+	switch entityType {
+	case "users":
+		privileges, _ = s.Bitbucket.GetUserPrivileges(r.Context(), owner, slug)
+	case "groups":
+		privileges, _ = s.Bitbucket.GetGroupPrivileges(r.Context(), owner, slug)
+	default:
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+
+	entities := make([]string, 0, len(privileges))
+	for entity := range privileges {
+		entities = append(entities, entity)
+	}
+	sort.Strings(entities)
+
+	values := []map[string]interface{}{}
+	for _, entity := range entities {
+		value := map[string]interface{}{"permission": privileges[entity]}
+		if entityType == "users" {
+			value["user"] = map[string]string{"account_id": entity}
+		} else {
+			value["group"] = map[string]string{"slug": entity}
+		}
+		values = append(values, value)
+	}
+
+	s.writePage(w, r, values)
+}
+
+func (s *Server) permissions(w http.ResponseWriter, r *http.Request, owner string, slug string, entityType string, entity string) {
+	if r.Method == "DELETE" {
+		switch entityType {
+		case "users":
+			writeDeleted(w, s.Bitbucket.DeleteUserPrivilege(r.Context(), owner, slug, entity))
+		case "groups":
+			writeDeleted(w, s.Bitbucket.DeleteGroupPrivilege(r.Context(), owner, slug, entity))
+		default:
+			writeError(w, http.StatusNotFound, "Resource not found")
+		}
+		return
+	}
+
+	if r.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	var body struct {
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeClientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var err error
+	switch entityType {
+	case "users":
+		err = s.Bitbucket.AddUserPrivilege(r.Context(), owner, slug, entity, body.Permission)
+	case "groups":
+		err = s.Bitbucket.AddGroupPrivilege(r.Context(), owner, slug, entity, body.Permission)
+	default:
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+
+	if err != nil {
+		writeClientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeDeleted responds to a DELETE request, treating errors as missing resources
+func writeDeleted(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeClientError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeClientError responds with an error returned by the fake, using its
+// status code if it has one
+func writeClientError(w http.ResponseWriter, status int, err error) {
+	var apiErr *gobucket.APIError
+	if errors.As(err, &apiErr) {
+		writeError(w, int(apiErr.StatusCode), apiErr.Message)
+		return
+	}
+
+	writeError(w, status, err.Error())
+}
+
+// writeError responds with an error in the format used by BitBucket
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"message": message},
+	})
+}
@@ -0,0 +1,91 @@
+package testserver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+func TestRepositoryPages(t *testing.T) {
+	server := New(nil)
+	defer server.Close()
+	server.PageLen = 2
+
+	for i := 0; i < 5; i++ {
+		server.Bitbucket.AddRepository("acme", fmt.Sprintf("repo%d", i), "")
+	}
+
+	repos, err := server.Client().GetRepositories(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repos) != 5 {
+		t.Fatalf("expected 5 repositories from 3 pages, got %d", len(repos))
+	}
+	for i, repo := range repos {
+		if expected := fmt.Sprintf("acme/repo%d", i); repo.FullName != expected {
+			t.Errorf("repository %d is '%s', expected '%s'", i, repo.FullName, expected)
+		}
+	}
+}
+
+func TestSettingsChangeTheFake(t *testing.T) {
+	server := New(nil)
+	defer server.Close()
+	server.Bitbucket.AddRepository("acme", "api", "")
+
+	ctx := context.Background()
+	client := server.Client()
+
+	if err := client.SetForks(ctx, "acme", "api", "none"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddDeployKey(ctx, "acme", "api", "ci", "ssh-ed25519 AAAA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddUserPrivilege(ctx, "acme", "api", "alice", "write"); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := server.Bitbucket.Repository("acme", "api")
+	if repo.Forks != "none" {
+		t.Errorf("expected forks 'none', got '%s'", repo.Forks)
+	}
+	if len(repo.DeployKeys) != 1 || repo.DeployKeys[0].Label != "ci" {
+		t.Errorf("unexpected deploy keys: %+v", repo.DeployKeys)
+	}
+	if repo.UserPrivileges["alice"] != "write" {
+		t.Errorf("unexpected user privileges: %v", repo.UserPrivileges)
+	}
+
+	keys, err := client.GetDeployKeys(ctx, "acme", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Key != "ssh-ed25519 AAAA" {
+		t.Errorf("unexpected deploy keys from the API: %+v", keys)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := New(nil)
+	defer server.Close()
+	server.Username = "user"
+	server.Password = "secret"
+
+	ctx := context.Background()
+
+	if _, err := server.Client().GetRepository(ctx, "acme", "missing"); !gobucket.IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	client := gobucket.New("user", "wrong")
+	client.BaseURL = server.URL
+
+	if _, err := client.GetRepositories(ctx, "acme"); !gobucket.IsPermissionDenied(err) {
+		t.Errorf("expected a permission error with wrong credentials, got %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Reads a policy and merges the policies it extends into it. The policies in
+'extends' are applied in order, and the policy itself is applied last, so
+later policies take precedence:
+
+  - Private, IssueTracker and Forks are overridden if they are set.
+  - DeployKeys, PostHooks, PreventDelete, PreventRebase and the Keep lists are
+    combined. A deploy key replaces an inherited key with the same name.
+  - The AccessManagement users and groups, and AllowPushes, are merged by
+    name. An entry replaces an inherited entry with the same name.
+  - Prune is set if any of the policies prunes.
+
+Inherited settings can't be removed. The resolved policy has no 'extends', so
+its hash changes when one of the policies it extends changes.
+*/
+func resolvePolicy(policyname string, chain []string) (repositorySettings, error) {
+	chain = append(chain, policyname)
+
+	policy, err := readPolicy(policyname)
+	if err != nil {
+		return repositorySettings{}, err
+	}
+
+	if len(policy.Extends) == 0 {
+		return policy, nil
+	}
+
+	var resolved repositorySettings
+	for _, parentname := range policy.Extends {
+		if contains(chain, parentname) {
+			return repositorySettings{}, fmt.Errorf("Policy '%s' extends itself (%s -> %s)", parentname, strings.Join(chain, " -> "), parentname)
+		}
+
+		parent, err := resolvePolicy(parentname, chain)
+		if err != nil {
+			return repositorySettings{}, fmt.Errorf("Error in policy '%s' extended by '%s': %w", parentname, policyname, err)
+		}
+
+		resolved = mergePolicies(resolved, parent)
+	}
+
+	return mergePolicies(resolved, policy), nil
+}
+
+// mergePolicies applies override on top of base
+func mergePolicies(base repositorySettings, override repositorySettings) repositorySettings {
+	merged := base
+	merged.Extends = nil
+
+	if override.Private != nil {
+		merged.Private = override.Private
+	}
+
+	if override.Forks != "" {
+		merged.Forks = override.Forks
+	}
+
+	if override.IssueTracker != nil {
+		merged.IssueTracker = override.IssueTracker
+	}
+
+	merged.DeployKeys = mergeDeployKeys(base.DeployKeys, override.DeployKeys)
+	merged.PostHooks = mergeLists(base.PostHooks, override.PostHooks)
+
+	merged.BranchManagement.PreventDelete = mergeLists(base.BranchManagement.PreventDelete, override.BranchManagement.PreventDelete)
+	merged.BranchManagement.PreventRebase = mergeLists(base.BranchManagement.PreventRebase, override.BranchManagement.PreventRebase)
+
+	if base.BranchManagement.AllowPushes != nil || override.BranchManagement.AllowPushes != nil {
+		merged.BranchManagement.AllowPushes = make(map[string]pushPermissions)
+		for branch, permissions := range base.BranchManagement.AllowPushes {
+			merged.BranchManagement.AllowPushes[branch] = permissions
+		}
+		for branch, permissions := range override.BranchManagement.AllowPushes {
+			merged.BranchManagement.AllowPushes[branch] = permissions
+		}
+	}
+
+	merged.AccessManagement.Users = mergeMaps(base.AccessManagement.Users, override.AccessManagement.Users)
+	merged.AccessManagement.Groups = mergeMaps(base.AccessManagement.Groups, override.AccessManagement.Groups)
+
+	merged.Prune = base.Prune || override.Prune
+	merged.Keep = pruneAllowlist{
+		DeployKeys: mergeLists(base.Keep.DeployKeys, override.Keep.DeployKeys),
+		PostHooks:  mergeLists(base.Keep.PostHooks, override.Keep.PostHooks),
+		Branches:   mergeLists(base.Keep.Branches, override.Keep.Branches),
+		Users:      mergeLists(base.Keep.Users, override.Keep.Users),
+		Groups:     mergeLists(base.Keep.Groups, override.Keep.Groups),
+	}
+
+	return merged
+}
+
+// mergeLists returns base followed by the entries of override that aren't in
+// base
+func mergeLists(base []string, override []string) []string {
+	if len(override) == 0 {
+		return base
+	}
+
+	merged := append([]string{}, base...)
+	for _, entry := range override {
+		if !contains(merged, entry) {
+			merged = append(merged, entry)
+		}
+	}
+
+	return merged
+}
+
+func mergeMaps(base map[string]string, override map[string]string) map[string]string {
+	if len(override) == 0 {
+		return base
+	}
+
+	merged := make(map[string]string, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// mergeDeployKeys combines the keys, replacing keys in base that have the same
+// name as a key in override
+func mergeDeployKeys(base publicKeyList, override publicKeyList) publicKeyList {
+	if len(override) == 0 {
+		return base
+	}
+
+	var merged publicKeyList
+	for _, key := range base {
+		if !override.hasName(key.Name) {
+			merged = append(merged, key)
+		}
+	}
+
+	return append(merged, override...)
+}
+
+func (keys publicKeyList) hasName(name string) bool {
+	for _, key := range keys {
+		if key.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var inheritPolicies = map[string]string{
+	"base.json": `{
+		"private": true,
+		"forks": "none",
+		"deploykeys": [{"name": "ci", "key": "` + testSSHKey + `"}, {"name": "backup", "key": "` + testSSHKey + `"}],
+		"posthooks": ["https://ci.example.com/hooks"],
+		"branchmanagement": {
+			"preventdelete": ["master"],
+			"allowpushes": {"master": {"users": ["alice"]}, "develop": {"groups": ["developers"]}}
+		},
+		"accessmanagement": {"users": {"alice": "admin"}, "groups": {"developers": "write"}},
+		"keep": {"users": ["bot"]}
+	}`,
+	"team.json": `{
+		"extends": ["base"],
+		"forks": "private",
+		"deploykeys": [{"name": "ci", "key": "` + testSSHKey + ` team"}],
+		"posthooks": ["https://ci.example.com/hooks", "https://chat.example.com/hooks"],
+		"branchmanagement": {
+			"preventdelete": ["release/*"],
+			"allowpushes": {"master": {"users": ["bob"]}}
+		},
+		"accessmanagement": {"users": {"bob": "write"}, "groups": {"developers": "read"}},
+		"prune": true,
+		"keep": {"users": ["deployer"], "groups": ["admins"]}
+	}`,
+	"service.json": `{"extends": ["team"], "private": false}`,
+}
+
+func TestResolvePolicy(t *testing.T) {
+	useTestServer(t, inheritPolicies)
+
+	policy, err := resolvePolicy("service", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.Extends != nil {
+		t.Errorf("expected the resolved policy to have no 'extends', got %v", policy.Extends)
+	}
+
+	if policy.Private == nil || *policy.Private || policy.Forks != "private" {
+		t.Errorf("expected the overridden private and forks settings, got %v and '%s'", policy.Private, policy.Forks)
+	}
+
+	expectedKeys := publicKeyList{{"backup", testSSHKey}, {"ci", testSSHKey + " team"}}
+	if !reflect.DeepEqual(policy.DeployKeys, expectedKeys) {
+		t.Errorf("expected the inherited 'ci' key to be replaced, got %v", policy.DeployKeys)
+	}
+
+	lists := []struct {
+		name     string
+		actual   []string
+		expected []string
+	}{
+		{"posthooks", policy.PostHooks, []string{"https://ci.example.com/hooks", "https://chat.example.com/hooks"}},
+		{"preventdelete", policy.BranchManagement.PreventDelete, []string{"master", "release/*"}},
+		{"keep.users", policy.Keep.Users, []string{"bot", "deployer"}},
+		{"keep.groups", policy.Keep.Groups, []string{"admins"}},
+	}
+
+	for _, list := range lists {
+		if !reflect.DeepEqual(list.actual, list.expected) {
+			t.Errorf("%s: expected the combined list %v, got %v", list.name, list.expected, list.actual)
+		}
+	}
+
+	expectedPushes := map[string]pushPermissions{
+		"master":  {Users: []string{"bob"}},
+		"develop": {Groups: []string{"developers"}},
+	}
+	if !reflect.DeepEqual(policy.BranchManagement.AllowPushes, expectedPushes) {
+		t.Errorf("expected allowpushes merged by branch, got %v", policy.BranchManagement.AllowPushes)
+	}
+
+	if expected := map[string]string{"alice": "admin", "bob": "write"}; !reflect.DeepEqual(policy.AccessManagement.Users, expected) {
+		t.Errorf("expected users merged by name, got %v", policy.AccessManagement.Users)
+	}
+	if expected := map[string]string{"developers": "read"}; !reflect.DeepEqual(policy.AccessManagement.Groups, expected) {
+		t.Errorf("expected groups merged by name, got %v", policy.AccessManagement.Groups)
+	}
+
+	if !policy.Prune {
+		t.Error("expected prune to be set by the extended policy")
+	}
+}
+
+func TestMergePrune(t *testing.T) {
+	tests := []struct {
+		base, override, expected bool
+	}{
+		{false, false, false},
+		{true, false, true},
+		{false, true, true},
+		{true, true, true},
+	}
+
+	for _, test := range tests {
+		merged := mergePolicies(repositorySettings{Prune: test.base}, repositorySettings{Prune: test.override})
+		if merged.Prune != test.expected {
+			t.Errorf("prune %v extended by prune %v: expected %v", test.base, test.override, test.expected)
+		}
+	}
+}
+
+func TestResolvePolicyErrors(t *testing.T) {
+	useTestServer(t, map[string]string{
+		"a.json":      `{"extends": ["b"]}`,
+		"b.json":      `{"extends": ["a"]}`,
+		"self.json":   `{"extends": ["self"]}`,
+		"orphan.json": `{"extends": ["missing"]}`,
+		"child.json":  `{"extends": ["orphan"]}`,
+	})
+
+	tests := []struct {
+		policyname string
+		err        string
+	}{
+		{"a", "Policy 'a' extends itself (a -> b -> a)"},
+		{"self", "Policy 'self' extends itself (self -> self)"},
+		{"orphan", "extends[0]: policy 'missing' doesn't exist"},
+		{"child", "Error in policy 'orphan' extended by 'child'"},
+	}
+
+	for _, test := range tests {
+		_, err := resolvePolicy(test.policyname, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.policyname, test.err, err)
+		}
+	}
+}
+
+func TestParentChangeReenforces(t *testing.T) {
+	server := useTestServer(t, map[string]string{
+		"base.json":    `{"private": false}`,
+		"default.json": `{"extends": ["base"]}`,
+	})
+
+	bb := server.Bitbucket
+	bb.AddRepository("acme", "api", "")
+
+	if failed, err := enforceAll(context.Background(), "acme", false); err != nil || failed != 0 {
+		t.Fatalf("enforceAll failed for %d repositories: %v", failed, err)
+	}
+	if bb.Repository("acme", "api").Private {
+		t.Fatal("the inherited setting wasn't enforced")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(*configDir, "base.json"), []byte(`{"private": false, "forks": "none"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if failed, err := enforceAll(context.Background(), "acme", false); err != nil || failed != 0 {
+		t.Fatalf("second enforceAll failed for %d repositories: %v", failed, err)
+	}
+	if forks := bb.Repository("acme", "api").Forks; forks != "none" {
+		t.Errorf("expected the change to the extended policy to be enforced, got forks '%s'", forks)
+	}
+}
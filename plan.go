@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+// Operations that a planned change can perform
+const (
+	opSetForks                = "setforks"
+	opSetPrivacy              = "setprivacy"
+	opSetIssueTracker         = "setissuetracker"
+	opSetDescription          = "setdescription"
+	opAddDeployKey            = "adddeploykey"
+	opDeleteDeployKey         = "deletedeploykey"
+	opAddService              = "addservice"
+	opDeleteService           = "deleteservice"
+	opAddBranchRestriction    = "addbranchrestriction"
+	opUpdateBranchRestriction = "updatebranchrestriction"
+	opDeleteBranchRestriction = "deletebranchrestriction"
+	opAddUserPrivilege        = "adduserprivilege"
+	opDeleteUserPrivilege     = "deleteuserprivilege"
+	opAddGroupPrivilege       = "addgroupprivilege"
+	opDeleteGroupPrivilege    = "deletegroupprivilege"
+)
+
+// change is a single modification of a repository. Action is "+" for
+// additions, "-" for removals and "~" for modifications.
+type change struct {
+	Action  string   `json:"action"`
+	Setting string   `json:"setting"`
+	Old     string   `json:"old,omitempty"`
+	New     string   `json:"new,omitempty"`
+	Op      string   `json:"op"`
+	Name    string   `json:"name,omitempty"`
+	Value   string   `json:"value,omitempty"`
+	ID      int      `json:"id,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+func (c change) String() string {
+	switch c.Action {
+	case "~":
+		return fmt.Sprintf("  ~ %s: %q -> %q", c.Setting, c.Old, c.New)
+	case "-":
+		return fmt.Sprintf("  - %s: %q", c.Setting, c.Old)
+	}
+
+	return fmt.Sprintf("  + %s: %q", c.Setting, c.New)
+}
+
+// repositoryPlan is the list of changes needed to enforce a policy on a
+// repository
+type repositoryPlan struct {
+	Owner      string   `json:"owner"`
+	Repo       string   `json:"repo"`
+	Policy     string   `json:"policy"`
+	PolicyHash string   `json:"policyhash"`
+	Commit     string   `json:"commit,omitempty"`
+	Changes    []change `json:"changes"`
+}
+
+func (p repositoryPlan) write(w io.Writer) {
+	fmt.Fprintf(w, "# %s/%s (policy '%s')\n", p.Owner, p.Repo, p.Policy)
+
+	if len(p.Changes) == 0 {
+		fmt.Fprintln(w, "  No changes.")
+		return
+	}
+
+	for _, c := range p.Changes {
+		fmt.Fprintln(w, redact(c.String()))
+	}
+}
+
+/*
+Computes the changes applyPolicy would make to a repository, by comparing
+the current settings with the policy. With -descriptiontag, the description
+is changed to include '-enforced' like the daemon does, unless it's already
+present.
+*/
+func planPolicy(ctx context.Context, owner string, repo string, policyname string) (repositoryPlan, error) {
+	plan := repositoryPlan{Owner: owner, Repo: repo, Policy: policyname}
+
+	repository, err := bbAPI.GetRepository(ctx, owner, repo)
+	if err != nil {
+		return plan, err
+	}
+
+	policy, err := repositoryPolicySettings(repository, policyname)
+	if err != nil {
+		return plan, err
+	}
+	plan.PolicyHash = policyHash(policy)
+	plan.Commit = policyCommit(policyname)
+
+	if policy.Forks != "" && repository.Forks() != policy.Forks {
+		plan.Changes = append(plan.Changes, change{Action: "~", Setting: "forks", Old: repository.Forks(), New: policy.Forks, Op: opSetForks, Value: policy.Forks})
+	}
+
+	if policy.Private != nil && repository.IsPrivate != *policy.Private {
+		plan.Changes = append(plan.Changes, change{Action: "~", Setting: "private", Old: fmt.Sprint(repository.IsPrivate), New: fmt.Sprint(*policy.Private), Op: opSetPrivacy, Value: fmt.Sprint(*policy.Private)})
+	}
+
+	if len(policy.DeployKeys) > 0 || policy.Prune {
+		changes, err := planDeployKeys(ctx, owner, repo, policy.DeployKeys, policy.pruning())
+		if err != nil {
+			return plan, err
+		}
+		plan.Changes = append(plan.Changes, changes...)
+	}
+
+	if len(policy.PostHooks) > 0 || policy.Prune {
+		hookList, err := bbAPI.GetServices(ctx, owner, repo)
+		if err != nil {
+			return plan, err
+		}
+
+		var currentHooks bbServices = hookList
+		for _, url := range policy.PostHooks {
+			if !currentHooks.hasPOSTHook(url) {
+				plan.Changes = append(plan.Changes, change{Action: "+", Setting: "posthooks", New: url, Op: opAddService, Value: url})
+			}
+		}
+
+		if policy.Prune {
+			for _, hook := range extraPOSTHooks(hookList, policy.PostHooks, policy.Keep.PostHooks) {
+				plan.Changes = append(plan.Changes, change{Action: "-", Setting: "posthooks", Old: hookURL(hook), Op: opDeleteService, Value: hook.UUID})
+			}
+		}
+	}
+
+	if policy.IssueTracker != nil && repository.HasIssues != *policy.IssueTracker {
+		plan.Changes = append(plan.Changes, change{Action: "~", Setting: "issuetracker", Old: fmt.Sprint(repository.HasIssues), New: fmt.Sprint(*policy.IssueTracker), Op: opSetIssueTracker, Value: fmt.Sprint(*policy.IssueTracker)})
+	}
+
+	changes, err := planBranchManagement(ctx, owner, repo, policy.BranchManagement, policy.pruning())
+	if err != nil {
+		return plan, err
+	}
+	plan.Changes = append(plan.Changes, changes...)
+
+	changes, err = planAccessManagement(ctx, owner, repo, policy.AccessManagement, policy.pruning())
+	if err != nil {
+		return plan, err
+	}
+	plan.Changes = append(plan.Changes, changes...)
+
+	if *descriptionTag && !strings.Contains(repository.Description, "-enforced") {
+		newDescription := strings.TrimSpace(fmt.Sprintf("%s\n\n-enforced", repository.Description))
+		plan.Changes = append(plan.Changes, change{Action: "~", Setting: "description", Old: repository.Description, New: newDescription, Op: opSetDescription, Value: newDescription})
+	}
+
+	return plan, nil
+}
+
+// planDeployKeys mirrors enforceDeployKeys
+func planDeployKeys(ctx context.Context, owner string, repo string, keys publicKeyList, prune *pruneAllowlist) ([]change, error) {
+	var changes []change
+
+	currkeys, err := bbAPI.GetDeployKeys(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	newkeys := make(publicKeyList, len(keys))
+	copy(newkeys, keys)
+
+	for _, key := range currkeys {
+		match, matchIndex := newkeys.hasKey(key)
+
+		if match == matchContent {
+			changes = append(changes, change{Action: "-", Setting: "deploykeys", Old: key.Label, Op: opDeleteDeployKey, ID: key.ID})
+		} else if match == matchExact {
+			newkeys = append(newkeys[:matchIndex], newkeys[(matchIndex+1):]...)
+		}
+	}
+
+	for _, key := range newkeys {
+		changes = append(changes, change{Action: "+", Setting: "deploykeys", New: key.Name, Op: opAddDeployKey, Name: key.Name, Value: key.Key})
+	}
+
+	if prune != nil {
+		for _, key := range extraDeployKeys(currkeys, keys, prune.DeployKeys) {
+			changes = append(changes, change{Action: "-", Setting: "deploykeys", Old: key.Label, Op: opDeleteDeployKey, ID: key.ID})
+		}
+	}
+
+	return changes, nil
+}
+
+// planBranchManagement mirrors enforceBranchManagement: it lists the
+// restrictions that don't exist yet, and the push restrictions whose users and
+// groups differ from the policy, like checkBranchManagement reports them
+func planBranchManagement(ctx context.Context, owner string, repo string, policies branchManagement, prune *pruneAllowlist) ([]change, error) {
+	var changes []change
+
+	if len(policies.PreventDelete) == 0 && len(policies.PreventRebase) == 0 && len(policies.AllowPushes) == 0 && prune == nil {
+		return nil, nil
+	}
+
+	restrictions, err := bbAPI.GetBranchRestrictions(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := func(kind string, branch string) bool {
+		_, ok := findBranchRestriction(restrictions, kind, branch)
+		return ok
+	}
+
+	for _, branch := range policies.PreventDelete {
+		if !exists("delete", branch) {
+			changes = append(changes, change{Action: "+", Setting: "branchmanagement.preventdelete", New: branch, Op: opAddBranchRestriction, Name: "delete", Value: branch})
+		}
+	}
+
+	for _, branch := range policies.PreventRebase {
+		if !exists("force", branch) {
+			changes = append(changes, change{Action: "+", Setting: "branchmanagement.preventrebase", New: branch, Op: opAddBranchRestriction, Name: "force", Value: branch})
+		}
+	}
+
+	for _, branch := range sortedPushBranches(policies.AllowPushes) {
+		permissions := policies.AllowPushes[branch]
+
+		restriction, ok := findBranchRestriction(restrictions, "push", branch)
+		if !ok {
+			changes = append(changes, change{Action: "+", Setting: "branchmanagement.allowpushes", New: branch, Op: opAddBranchRestriction, Name: "push", Value: branch, Users: permissions.Users, Groups: permissions.Groups})
+			continue
+		}
+
+		if users, groups, changed := pushRestrictionMembers(restriction, permissions, prune != nil); changed {
+			changes = append(changes, change{
+				Action:  "~",
+				Setting: fmt.Sprintf("branchmanagement.allowpushes.%s", branch),
+				Old:     describeMembers(restriction.Users, restriction.Groups),
+				New:     describeMembers(users, groups),
+				Op:      opUpdateBranchRestriction,
+				Name:    "push",
+				Value:   branch,
+				ID:      restriction.ID,
+				Users:   users,
+				Groups:  groups,
+			})
+		}
+	}
+
+	if prune != nil {
+		for _, restriction := range extraBranchRestrictions(restrictions, policies, prune.Branches) {
+			setting := fmt.Sprintf("branchmanagement.%s", restriction.Kind)
+			changes = append(changes, change{Action: "-", Setting: setting, Old: restriction.Pattern, Op: opDeleteBranchRestriction, ID: restriction.ID})
+		}
+	}
+
+	return changes, nil
+}
+
+// describeMembers formats the users and groups of a push restriction
+func describeMembers(users []string, groups []string) string {
+	return fmt.Sprintf("users: %s; groups: %s", strings.Join(users, ", "), strings.Join(groups, ", "))
+}
+
+func planAccessManagement(ctx context.Context, owner string, repo string, policies accessManagement, prune *pruneAllowlist) ([]change, error) {
+	var changes []change
+
+	if len(policies.Users) > 0 || prune != nil {
+		privileges, err := bbAPI.GetUserPrivileges(ctx, owner, repo)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planPrivileges("accessmanagement.users", opAddUserPrivilege, policies.Users, privileges)...)
+
+		if prune != nil {
+			keep, err := keptUsers(ctx, prune)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, username := range extraPrivileges(privileges, policies.Users, keep) {
+				changes = append(changes, change{Action: "-", Setting: fmt.Sprintf("accessmanagement.users.%s", username), Old: privileges[username], Op: opDeleteUserPrivilege, Name: username})
+			}
+		}
+	}
+
+	if len(policies.Groups) > 0 || prune != nil {
+		privileges, err := bbAPI.GetGroupPrivileges(ctx, owner, repo)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planPrivileges("accessmanagement.groups", opAddGroupPrivilege, policies.Groups, privileges)...)
+
+		if prune != nil {
+			for _, groupname := range extraPrivileges(privileges, policies.Groups, prune.Groups) {
+				changes = append(changes, change{Action: "-", Setting: fmt.Sprintf("accessmanagement.groups.%s", groupname), Old: privileges[groupname], Op: opDeleteGroupPrivilege, Name: groupname})
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func planPrivileges(setting string, op string, expected map[string]string, actual map[string]string) []change {
+	var changes []change
+
+	for _, entity := range sortedKeys(expected) {
+		privilege, ok := actual[entity]
+
+		if !ok {
+			changes = append(changes, change{Action: "+", Setting: fmt.Sprintf("%s.%s", setting, entity), New: expected[entity], Op: op, Name: entity, Value: expected[entity]})
+		} else if privilege != expected[entity] {
+			changes = append(changes, change{Action: "~", Setting: fmt.Sprintf("%s.%s", setting, entity), Old: privilege, New: expected[entity], Op: op, Name: entity, Value: expected[entity]})
+		}
+	}
+
+	return changes
+}
+
+// applyPlan executes the changes of a plan in order and records the result
+// in the state store
+func applyPlan(ctx context.Context, plan repositoryPlan) error {
+	fullName := fmt.Sprintf("%s/%s", plan.Owner, plan.Repo)
+
+	for _, c := range plan.Changes {
+		if err := applyChange(ctx, plan.Owner, plan.Repo, c); err != nil {
+			err = fmt.Errorf("%s: %s: %s", fullName, c.Setting, err)
+			recordState(fullName, "", plan.Policy, plan.PolicyHash, plan.Commit, err)
+			return err
+		}
+	}
+
+	recordState(fullName, "", plan.Policy, plan.PolicyHash, plan.Commit, nil)
+
+	return nil
+}
+
+func applyChange(ctx context.Context, owner string, repo string, c change) error {
+	switch c.Op {
+	case opSetForks:
+		return bbAPI.SetForks(ctx, owner, repo, c.Value)
+	case opSetPrivacy:
+		return bbAPI.SetPrivacy(ctx, owner, repo, c.Value == "true")
+	case opSetIssueTracker:
+		return bbAPI.SetIssueTracker(ctx, owner, repo, c.Value == "true")
+	case opSetDescription:
+		return bbAPI.SetDescription(ctx, owner, repo, c.Value)
+	case opAddDeployKey:
+		return bbAPI.AddDeployKey(ctx, owner, repo, c.Name, c.Value)
+	case opDeleteDeployKey:
+		return ignoreNotFound(bbAPI.DeleteDeployKey(ctx, owner, repo, c.ID))
+	case opAddService:
+		return bbAPI.AddService(ctx, owner, repo, "POST", map[string]string{"URL": c.Value})
+	case opDeleteService:
+		return ignoreNotFound(bbAPI.DeleteService(ctx, owner, repo, c.Value))
+	case opAddBranchRestriction:
+		return bbAPI.AddBranchRestriction(ctx, owner, repo, c.Name, c.Value, c.Users, c.Groups)
+	case opUpdateBranchRestriction:
+		return bbAPI.UpdateBranchRestriction(ctx, owner, repo, gobucket.BranchRestriction{ID: c.ID, Kind: c.Name, Pattern: c.Value, Users: c.Users, Groups: c.Groups})
+	case opDeleteBranchRestriction:
+		return ignoreNotFound(bbAPI.DeleteBranchRestriction(ctx, owner, repo, c.ID))
+	case opAddUserPrivilege:
+		return bbAPI.AddUserPrivilege(ctx, owner, repo, c.Name, c.Value)
+	case opDeleteUserPrivilege:
+		return ignoreNotFound(bbAPI.DeleteUserPrivilege(ctx, owner, repo, c.Name))
+	case opAddGroupPrivilege:
+		return bbAPI.AddGroupPrivilege(ctx, owner, repo, c.Name, c.Value)
+	case opDeleteGroupPrivilege:
+		return ignoreNotFound(bbAPI.DeleteGroupPrivilege(ctx, owner, repo, c.Name))
+	}
+
+	return fmt.Errorf("Unknown operation '%s'", c.Op)
+}
+
+// planRepositories plans a single repository if target is "owner/repo", or
+// every repository of bbUsername that isn't marked '-noenforce' otherwise
+func planRepositories(ctx context.Context, bbUsername string, target string) ([]repositoryPlan, error) {
+	var repos []gobucket.Repository
+
+	if target != "" {
+		repository, err := getRepository(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repository)
+	} else {
+		var err error
+		if repos, err = bbAPI.GetRepositories(ctx, bbUsername); err != nil {
+			return nil, err
+		}
+	}
+
+	var plans []repositoryPlan
+	for _, repo := range repos {
+		if strings.Contains(repo.Description, "-noenforce") {
+			continue
+		}
+
+		parts := strings.Split(repo.FullName, "/")
+
+		plan, err := planPolicy(ctx, parts[0], parts[1], repositoryPolicy(repo))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", repo.FullName, err)
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+func writePlans(w io.Writer, plans []repositoryPlan) {
+	var added, changed, destroyed int
+
+	for _, plan := range plans {
+		plan.write(w)
+		fmt.Fprintln(w)
+
+		for _, c := range plan.Changes {
+			switch c.Action {
+			case "+":
+				added++
+			case "~":
+				changed++
+			case "-":
+				destroyed++
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "Plan: %d to add, %d to change, %d to destroy.\n", added, changed, destroyed)
+}
+
+// runPlan implements the 'plan [-out file] [owner/repo]' command
+func runPlan(ctx context.Context, bbUsername string, args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	out := flags.String("out", "", "write the plan to this file so it can be applied later")
+	targets := parseCommand(flags, args)
+
+	plans, err := planRepositories(ctx, bbUsername, firstArg(targets))
+	if err != nil {
+		return err
+	}
+
+	writePlans(os.Stdout, plans)
+
+	if *out != "" {
+		planJSON, _ := json.MarshalIndent(plans, "", "  ")
+		return writePlanFile(*out, planJSON)
+	}
+
+	return nil
+}
+
+// writePlanFile writes a plan that only the owner can read, as the values it
+// applies include the secrets resolved from references in policies
+func writePlanFile(filename string, planJSON []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// The permissions of an existing file aren't changed by OpenFile
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(planJSON); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// filterPlans returns the plans for the repository "owner/repo"
+func filterPlans(plans []repositoryPlan, target string) []repositoryPlan {
+	var filtered []repositoryPlan
+	for _, plan := range plans {
+		if strings.EqualFold(fmt.Sprintf("%s/%s", plan.Owner, plan.Repo), target) {
+			filtered = append(filtered, plan)
+		}
+	}
+
+	return filtered
+}
+
+func hasChanges(plans []repositoryPlan) bool {
+	for _, plan := range plans {
+		if len(plan.Changes) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// confirmApply asks whether the changes should be applied, and only accepts
+// "yes"
+func confirmApply() bool {
+	fmt.Print("Apply these changes? Only 'yes' will be accepted: ")
+
+	answer, _ := bufio.NewReader(confirmInput).ReadString('\n')
+
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// confirmInput is where apply reads the confirmation from
+var confirmInput io.Reader = os.Stdin
+
+/*
+Implements the 'apply [-plan file] [-auto-approve] [owner/repo]' command. With
+a plan file, exactly the changes in the file are applied, for a single
+repository if one is given. Otherwise the repositories are planned again, and
+the changes are only applied after confirming them, unless -auto-approve is
+given.
+*/
+func runApply(ctx context.Context, bbUsername string, args []string) error {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	planFile := flags.String("plan", "", "apply the plan in this file instead of planning again")
+	autoApprove := flags.Bool("auto-approve", false, "apply the changes without asking for confirmation")
+	targets := parseCommand(flags, args)
+	target := firstArg(targets)
+
+	var plans []repositoryPlan
+
+	if *planFile != "" {
+		rawPlan, err := ioutil.ReadFile(*planFile)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(rawPlan, &plans); err != nil {
+			return err
+		}
+
+		if target != "" {
+			if plans = filterPlans(plans, target); len(plans) == 0 {
+				return fmt.Errorf("The plan in '%s' has no repository '%s'", *planFile, target)
+			}
+		}
+	} else {
+		var err error
+		if plans, err = planRepositories(ctx, bbUsername, target); err != nil {
+			return err
+		}
+	}
+
+	writePlans(os.Stdout, plans)
+
+	if *planFile == "" && !*autoApprove && hasChanges(plans) && !confirmApply() {
+		return errors.New("Apply cancelled")
+	}
+
+	for _, plan := range plans {
+		if err := applyPlan(ctx, plan); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Apply complete.")
+
+	return nil
+}
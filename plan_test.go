@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanPushRestrictionMembers(t *testing.T) {
+	server := useTestServer(t, map[string]string{
+		"default.json": `{"branchmanagement": {"allowpushes": {"master": {"users": ["bob"]}}}}`,
+	})
+
+	ctx := context.Background()
+	server.Bitbucket.AddRepository("acme", "api", "")
+	server.Bitbucket.AddBranchRestriction(ctx, "acme", "api", "push", "master", []string{"alice"}, nil)
+
+	repo, err := bbAPI.GetRepository(ctx, "acme", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := repositoryPolicySettings(repo, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviations, err := checkPolicy(ctx, "acme", "api", policy)
+	if err != nil || len(deviations) != 1 {
+		t.Fatalf("expected check to report the missing user, got %v, %v", deviations, err)
+	}
+
+	plan, err := planPolicy(ctx, "acme", "api", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 1 || plan.Changes[0].Op != opUpdateBranchRestriction {
+		t.Fatalf("expected the plan to update the push restriction, got %v", plan.Changes)
+	}
+
+	if err := applyPlan(ctx, plan); err != nil {
+		t.Fatal(err)
+	}
+
+	if deviations, err := checkPolicy(ctx, "acme", "api", policy); err != nil || len(deviations) != 0 {
+		t.Errorf("expected no deviations after applying, got %v, %v", deviations, err)
+	}
+	if plan, err := planPolicy(ctx, "acme", "api", "default"); err != nil || len(plan.Changes) != 0 {
+		t.Errorf("expected no changes after applying, got %v, %v", plan.Changes, err)
+	}
+}
+
+func TestApplyConfirmation(t *testing.T) {
+	server := useTestServer(t, map[string]string{"default.json": `{"private": false}`})
+	server.Bitbucket.AddRepository("acme", "api", "")
+
+	defer func(old io.Reader) { confirmInput = old }(confirmInput)
+
+	tests := []struct {
+		args    []string
+		input   string
+		applied bool
+	}{
+		{nil, "", false},
+		{nil, "no\n", false},
+		{[]string{"-auto-approve"}, "", true},
+		{nil, "yes\n", true},
+	}
+
+	for _, test := range tests {
+		server.Bitbucket.Repository("acme", "api").Private = true
+		confirmInput = strings.NewReader(test.input)
+
+		err := runApply(context.Background(), "acme", test.args)
+		if test.applied && err != nil {
+			t.Errorf("%v %q: %s", test.args, test.input, err)
+		} else if !test.applied && err == nil {
+			t.Errorf("%v %q: expected apply to be cancelled", test.args, test.input)
+		}
+
+		if applied := !server.Bitbucket.Repository("acme", "api").Private; applied != test.applied {
+			t.Errorf("%v %q: expected applied to be %v", test.args, test.input, test.applied)
+		}
+	}
+}
+
+func TestApplyPlanFileForRepository(t *testing.T) {
+	server := useTestServer(t, map[string]string{"default.json": `{"private": false}`})
+	server.Bitbucket.AddRepository("acme", "api", "")
+	server.Bitbucket.AddRepository("acme", "web", "")
+
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	if err := runPlan(context.Background(), "acme", []string{"-out", planFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runApply(context.Background(), "acme", []string{"-plan", planFile, "acme/missing"}); err == nil {
+		t.Error("expected an error for a repository that isn't in the plan")
+	}
+
+	if err := runApply(context.Background(), "acme", []string{"-plan", planFile, "acme/web"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !server.Bitbucket.Repository("acme", "api").Private || server.Bitbucket.Repository("acme", "web").Private {
+		t.Error("expected only acme/web to be changed")
+	}
+}
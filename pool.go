@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+/*
+Calls fn for every repository using -workers goroutines and returns the number
+of calls that failed. Every call gets -repotimeout to finish.
+
+When ctx is cancelled, no more repositories are started. Repositories that are
+already being processed are allowed -shutdowntimeout to finish before their
+context is cancelled as well, so a shutdown doesn't leave them half enforced
+unless it has to.
+*/
+func forEachRepository(ctx context.Context, repos []gobucket.Repository, fn func(context.Context, gobucket.Repository) error) int {
+	n := *workers
+	if n < 1 {
+		n = 1
+	}
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+
+		select {
+		case <-time.After(*shutdownTimeout):
+			cancelWork()
+		case <-done:
+		}
+	}()
+
+	queue := make(chan gobucket.Repository)
+	var failed int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for repo := range queue {
+				if err := withRepositoryTimeout(workCtx, repo, fn); err != nil {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+queueing:
+	for _, repo := range repos {
+		select {
+		case queue <- repo:
+		case <-ctx.Done():
+			break queueing
+		}
+	}
+	close(queue)
+
+	wg.Wait()
+
+	return int(failed)
+}
+
+// withRepositoryTimeout calls fn with a context that expires after
+// -repotimeout
+func withRepositoryTimeout(ctx context.Context, repo gobucket.Repository, fn func(context.Context, gobucket.Repository) error) error {
+	ctx, cancel := repositoryContext(ctx)
+	defer cancel()
+
+	return fn(ctx, repo)
+}
+
+// repositoryContext returns a context that expires after -repotimeout
+func repositoryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *repoTimeout > 0 {
+		return context.WithTimeout(ctx, *repoTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+// pruneAllowlist lists settings that are kept when pruning, even though they
+// are not in the policy
+type pruneAllowlist struct {
+	DeployKeys []string // key labels
+	PostHooks  []string // hook URLs
+	Branches   []string // branch patterns
+	Users      []string
+	Groups     []string
+}
+
+func contains(list []string, needle string) bool {
+	for _, entry := range list {
+		if entry == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ignoreNotFound treats deleting a setting that is already gone as a success
+func ignoreNotFound(err error) error {
+	if gobucket.IsNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+func hookURL(hook gobucket.Service) string {
+	for _, field := range hook.Service.Fields {
+		if field.Name == "URL" {
+			return field.Value
+		}
+	}
+
+	return ""
+}
+
+// extraDeployKeys returns the keys whose content isn't in the policy
+func extraDeployKeys(current []gobucket.DeployKey, keys publicKeyList, keep []string) []gobucket.DeployKey {
+	var extra []gobucket.DeployKey
+
+	for _, key := range current {
+		if match, _ := keys.hasKey(key); match == matchNone && !contains(keep, key.Label) {
+			extra = append(extra, key)
+		}
+	}
+
+	return extra
+}
+
+// extraPOSTHooks returns the POST hooks whose URL isn't in the policy
+func extraPOSTHooks(current []gobucket.Service, hookURLs []string, keep []string) []gobucket.Service {
+	var extra []gobucket.Service
+
+	for _, hook := range current {
+		url := hookURL(hook)
+
+		if hook.Service.Type == "POST" && !contains(hookURLs, url) && !contains(keep, url) {
+			extra = append(extra, hook)
+		}
+	}
+
+	return extra
+}
+
+/*
+Returns the branch restrictions that aren't in the policy. Only the kinds of
+restrictions that can be set by a policy ("delete", "force" and "push") are
+considered.
+*/
+func extraBranchRestrictions(current []gobucket.BranchRestriction, policies branchManagement, keep []string) []gobucket.BranchRestriction {
+	var extra []gobucket.BranchRestriction
+
+	for _, restriction := range current {
+		if contains(keep, restriction.Pattern) {
+			continue
+		}
+
+		var declared bool
+		switch restriction.Kind {
+		case "delete":
+			declared = contains(policies.PreventDelete, restriction.Pattern)
+		case "force":
+			declared = contains(policies.PreventRebase, restriction.Pattern)
+		case "push":
+			_, declared = policies.AllowPushes[restriction.Pattern]
+		default:
+			declared = true
+		}
+
+		if !declared {
+			extra = append(extra, restriction)
+		}
+	}
+
+	return extra
+}
+
+// findBranchRestriction returns the restriction of a kind on a branch pattern
+func findBranchRestriction(restrictions []gobucket.BranchRestriction, kind string, branch string) (gobucket.BranchRestriction, bool) {
+	for _, restriction := range restrictions {
+		if restriction.Kind == kind && restriction.Pattern == branch {
+			return restriction, true
+		}
+	}
+
+	return gobucket.BranchRestriction{}, false
+}
+
+// memberChanges returns the expected entries that are missing from actual,
+// and when pruning, the entries in actual that aren't expected
+func memberChanges(expected []string, actual []string, prune bool) ([]string, []string) {
+	missing := missingEntries(expected, actual)
+
+	var extra []string
+	if prune {
+		extra = missingEntries(actual, expected)
+	}
+
+	return missing, extra
+}
+
+/*
+Returns the users and groups a push restriction must have to match the
+policy, and whether they differ from the current ones. Missing users and
+groups are added, and the others are only removed when pruning.
+*/
+func pushRestrictionMembers(restriction gobucket.BranchRestriction, permissions pushPermissions, prune bool) ([]string, []string, bool) {
+	users, changed := updatedMembers(permissions.Users, restriction.Users, prune)
+	groups, groupsChanged := updatedMembers(permissions.Groups, restriction.Groups, prune)
+
+	return users, groups, changed || groupsChanged
+}
+
+func updatedMembers(expected []string, actual []string, prune bool) ([]string, bool) {
+	missing, extra := memberChanges(expected, actual, prune)
+	if len(missing) == 0 && len(extra) == 0 {
+		return actual, false
+	}
+
+	if prune {
+		return append([]string(nil), expected...), true
+	}
+
+	return append(append([]string(nil), actual...), missing...), true
+}
+
+// extraPrivileges returns the users or groups that have privileges on a
+// repository without being in the policy
+func extraPrivileges(current map[string]string, expected map[string]string, keep []string) []string {
+	var extra []string
+
+	for _, entity := range sortedKeys(current) {
+		if _, ok := expected[entity]; !ok && !contains(keep, entity) {
+			extra = append(extra, entity)
+		}
+	}
+
+	return extra
+}
+
+// keptUsers returns the users whose privileges are kept when pruning. The
+// account the enforcer uses is always kept, so it can't revoke its own access.
+func keptUsers(ctx context.Context, prune *pruneAllowlist) ([]string, error) {
+	account, err := bbAPI.CurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{account.AccountID}, prune.Users...), nil
+}
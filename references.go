@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// referencePattern matches '${env:NAME}' and '${file:path}' references. A
+// reference preceded by another '$' is not resolved.
+var referencePattern = regexp.MustCompile(`\$?\$\{([a-z]+):([^}]*)\}`)
+
+/*
+Resolves the references in the values of a policy, so secrets such as deploy
+keys and hook URLs with tokens don't have to be in the policy file:
+
+  - '${env:NAME}' is the value of the environment variable NAME.
+  - '${file:path}' is the content of the file, without leading and trailing
+    white space. A relative path is relative to the folder of the policy.
+
+References can be part of a longer value, and '$${env:NAME}' is the literal
+text '${env:NAME}'. A reference that can't be resolved is a validation error.
+If the policy isn't valid JSON, it is returned as-is so validation reports the
+syntax error.
+*/
+func resolveReferences(filename string, rawConfig []byte) ([]byte, error) {
+	if !referencePattern.Match(rawConfig) {
+		return rawConfig, nil
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(rawConfig, &generic); err != nil {
+		return rawConfig, nil
+	}
+
+	var errs validationErrors
+	generic = resolveValue(filename, "", generic, &errs)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return json.Marshal(generic)
+}
+
+func resolveValue(filename string, jsonPath string, value interface{}, errs *validationErrors) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedObjectKeys(value) {
+			value[key] = resolveValue(filename, joinPath(jsonPath, key), value[key], errs)
+		}
+
+	case []interface{}:
+		for i, entry := range value {
+			value[i] = resolveValue(filename, fmt.Sprintf("%s[%d]", jsonPath, i), entry, errs)
+		}
+
+	case string:
+		return referencePattern.ReplaceAllStringFunc(value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+
+			resolved, err := resolveReference(filename, reference)
+			if err != nil {
+				*errs = append(*errs, validationError{filename, jsonPath, err.Error()})
+				return reference
+			}
+
+			secrets.add(resolved, reference)
+
+			return resolved
+		})
+	}
+
+	return value
+}
+
+func resolveReference(filename string, reference string) (string, error) {
+	match := referencePattern.FindStringSubmatch(reference)
+	kind, name := match[1], match[2]
+
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: the environment variable '%s' isn't set", reference, name)
+		}
+
+		return value, nil
+
+	case "file":
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(filename), name)
+		}
+
+		referencedFiles.add(name)
+
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", reference, err)
+		}
+
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	return "", fmt.Errorf("%s: unknown reference, use ${env:NAME} or ${file:path}", reference)
+}
+
+// fileSet is a set of file names. It is safe for concurrent use.
+type fileSet struct {
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+// referencedFiles are the files that have been read for '${file:path}'
+// references, so the daemon can reload the policies when they change
+var referencedFiles = &fileSet{files: make(map[string]bool)}
+
+func (s *fileSet) add(filename string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[filename] = true
+}
+
+func (s *fileSet) sorted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make([]string, 0, len(s.files))
+	for filename := range s.files {
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// secretValues maps the values resolved from references to the references,
+// so they can be hidden in log messages. It is safe for concurrent use.
+type secretValues struct {
+	mu         sync.RWMutex
+	references map[string]string
+	values     []string // longest first
+}
+
+var secrets = &secretValues{references: make(map[string]string)}
+
+// minSecretLength is the length of the shortest value that is redacted. Even
+// shorter values would hide unrelated parts of the log messages.
+const minSecretLength = 4
+
+func (s *secretValues) add(value string, reference string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.references[value]; ok {
+		return
+	}
+
+	s.references[value] = reference
+	s.values = append(s.values, value)
+	sort.SliceStable(s.values, func(i, j int) bool {
+		return len(s.values[i]) > len(s.values[j])
+	})
+}
+
+// redact replaces the values resolved from references in a log message with
+// the references, e.g. '${env:DEPLOY_KEY_CI}'
+func redact(message string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+
+	for _, value := range secrets.values {
+		message = strings.Replace(message, value, secrets.references[value], -1)
+	}
+
+	return message
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSecrets replaces the redacted values until the test ends
+func useSecrets(t *testing.T) {
+	old := secrets
+	secrets = &secretValues{references: make(map[string]string)}
+	t.Cleanup(func() { secrets = old })
+}
+
+func TestResolveReferences(t *testing.T) {
+	useSecrets(t)
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "keys"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "keys", "ci.pub"), []byte("\n  ssh-ed25519 AAAA ci\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	absolute := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(absolute, []byte("s3cr3t-token"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ENFORCER_TEST_HOOK", "https://ci.example.com")
+
+	filename := filepath.Join(dir, "default.json")
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"no references", "no references"},
+		{"${env:ENFORCER_TEST_HOOK}", "https://ci.example.com"},
+		{"${env:ENFORCER_TEST_HOOK}/hooks?token=${file:" + absolute + "}", "https://ci.example.com/hooks?token=s3cr3t-token"},
+		{"${file:keys/ci.pub}", "ssh-ed25519 AAAA ci"},
+		{"$${env:ENFORCER_TEST_HOOK}", "${env:ENFORCER_TEST_HOOK}"},
+		{"$${file:keys/ci.pub} and ${file:keys/ci.pub}", "${file:keys/ci.pub} and ssh-ed25519 AAAA ci"},
+	}
+
+	for _, test := range tests {
+		rawConfig, _ := json.Marshal(map[string]interface{}{"posthooks": []string{test.value}})
+
+		resolved, err := resolveReferences(filename, rawConfig)
+		if err != nil {
+			t.Errorf("%s: %s", test.value, err)
+			continue
+		}
+
+		var policy repositorySettings
+		if err := json.Unmarshal(resolved, &policy); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(policy.PostHooks) != 1 || policy.PostHooks[0] != test.expected {
+			t.Errorf("%s: expected '%s', got %v", test.value, test.expected, policy.PostHooks)
+		}
+	}
+}
+
+func TestResolveReferenceErrors(t *testing.T) {
+	useSecrets(t)
+
+	filename := filepath.Join(t.TempDir(), "default.json")
+
+	tests := []struct {
+		rawConfig string
+		err       string
+	}{
+		{`{"posthooks": ["${env:ENFORCER_TEST_MISSING}"]}`, "posthooks[0]: ${env:ENFORCER_TEST_MISSING}: the environment variable 'ENFORCER_TEST_MISSING' isn't set"},
+		{`{"deploykeys": [{"name": "ci", "key": "${file:missing.pub}"}]}`, "deploykeys[0].key: ${file:missing.pub}: open "},
+		{`{"forks": "${vault:forks}"}`, "forks: ${vault:forks}: unknown reference"},
+	}
+
+	for _, test := range tests {
+		_, err := resolveReferences(filename, []byte(test.rawConfig))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.rawConfig, test.err, err)
+		}
+	}
+
+	// Invalid JSON is left for validation to report
+	if resolved, err := resolveReferences(filename, []byte(`{"forks": "${env:X}"`)); err != nil || string(resolved) != `{"forks": "${env:X}"` {
+		t.Errorf("expected invalid JSON to be returned as-is, got %s, %v", resolved, err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	useSecrets(t)
+
+	t.Setenv("ENFORCER_TEST_TOKEN", "s3cr3t-token")
+	t.Setenv("ENFORCER_TEST_PREFIX", "s3cr3t")
+	t.Setenv("ENFORCER_TEST_SHORT", "abc")
+
+	rawConfig := `{"posthooks": ["${env:ENFORCER_TEST_TOKEN}", "${env:ENFORCER_TEST_PREFIX}", "${env:ENFORCER_TEST_SHORT}"]}`
+	if _, err := resolveReferences("default.json", []byte(rawConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{"token s3cr3t-token", "token ${env:ENFORCER_TEST_TOKEN}"},
+		{"prefix s3cr3t only", "prefix ${env:ENFORCER_TEST_PREFIX} only"},
+		{"abc is too short to hide", "abc is too short to hide"},
+		{"nothing secret", "nothing secret"},
+	}
+
+	for _, test := range tests {
+		if redacted := redact(test.message); redacted != test.expected {
+			t.Errorf("expected '%s' to be redacted to '%s', got '%s'", test.message, test.expected, redacted)
+		}
+	}
+
+	err := validationError{"default.json", "posthooks[0]", "'s3cr3t-token' must be an http or https URL"}
+	if expected := "default.json: posthooks[0]: '${env:ENFORCER_TEST_TOKEN}' must be an http or https URL"; err.Error() != expected {
+		t.Errorf("expected the validation error '%s', got '%s'", expected, err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+/*
+policyStore holds the policies the daemon enforces, so the config folder can
+be changed while it runs. reload validates every policy before the whole set is
+replaced at once. A policy that has become invalid keeps its last good
+version, so a mistake in a policy file never changes repositories. It is safe
+for concurrent use.
+*/
+type policyStore struct {
+	mu       sync.RWMutex
+	policies map[string]repositorySettings
+	hashes   map[string]string
+	commits  map[string]string // with -configrepo, the commit of each policy
+	errs     map[string]error  // policies that have never been valid
+	version  string
+}
+
+// policies is loaded by the daemon. Without it, policies are read from the
+// config folder whenever they are needed.
+var policies *policyStore
+
+// openPolicyStore loads every policy in the config folder
+func openPolicyStore() *policyStore {
+	store := &policyStore{
+		policies: make(map[string]repositorySettings),
+		hashes:   make(map[string]string),
+		commits:  make(map[string]string),
+		errs:     make(map[string]error),
+	}
+
+	store.reload()
+
+	return store
+}
+
+func (s *policyStore) get(policyname string) (repositorySettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if policy, ok := s.policies[policyname]; ok {
+		return policy, nil
+	}
+
+	if err, ok := s.errs[policyname]; ok {
+		return repositorySettings{}, err
+	}
+
+	return repositorySettings{}, fmt.Errorf("Policy '%s' doesn't exist in '%s'", policyname, *configDir)
+}
+
+// commit returns the commit of the config repository the policy was read from
+func (s *policyStore) commit(policyname string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.commits[policyname]
+}
+
+/*
+Reads the config folder again if any policy file has been added, changed or
+removed since the last reload, and returns the names of the policies whose
+content changed. Invalid policies are logged and keep their last good version.
+*/
+func (s *policyStore) reload() []string {
+	version, err := policyDirVersion()
+	if err != nil {
+		log.Error("Error reading policies", err)
+		return nil
+	}
+
+	s.mu.RLock()
+	unchanged := version == s.version
+	s.mu.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	policynames, err := policyNames()
+	if err != nil {
+		log.Error("Error reading policies", err)
+		return nil
+	}
+
+	var commit string
+	if configRepo != nil {
+		commit = configRepo.currentCommit()
+	}
+
+	s.mu.RLock()
+	loaded := make(map[string]repositorySettings, len(policynames))
+	hashes := make(map[string]string, len(policynames))
+	commits := make(map[string]string, len(policynames))
+	errs := make(map[string]error)
+
+	for _, policyname := range policynames {
+		policy, err := resolvePolicy(policyname, nil)
+		if err == nil {
+			loaded[policyname] = policy
+			hashes[policyname] = policyHash(policy)
+			commits[policyname] = commit
+			continue
+		}
+
+		if last, ok := s.policies[policyname]; ok {
+			log.Error(fmt.Sprintf("Policy '%s' is invalid, keeping the last good version:", policyname), err)
+			loaded[policyname] = last
+			hashes[policyname] = s.hashes[policyname]
+			commits[policyname] = s.commits[policyname]
+		} else {
+			log.Error(fmt.Sprintf("Policy '%s' is invalid:", policyname), err)
+			errs[policyname] = err
+		}
+	}
+
+	changed := changedPolicies(s.hashes, hashes)
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	s.policies = loaded
+	s.hashes = hashes
+	s.commits = commits
+	s.errs = errs
+	s.version = version
+	s.mu.Unlock()
+
+	if *verbose {
+		for _, policyname := range changed {
+			if policy, ok := loaded[policyname]; ok {
+				log.Info(fmt.Sprintf("Loaded policy '%s': ", policyname), redact(fmt.Sprint(policy)))
+			}
+		}
+	}
+
+	return changed
+}
+
+// policyDirVersion identifies the names, sizes and modification times of the
+// policy files and the files they reference, so reloading can be skipped if
+// none of them changed
+func policyDirVersion() (string, error) {
+	entries, err := ioutil.ReadDir(*configDir)
+	if err != nil {
+		return "", err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !contains(policyExtensions, filepath.Ext(entry.Name())) {
+			continue
+		}
+
+		files = append(files, fmt.Sprintf("%s:%d:%d", entry.Name(), entry.Size(), entry.ModTime().UnixNano()))
+	}
+	sort.Strings(files)
+
+	for _, filename := range referencedFiles.sorted() {
+		if info, err := os.Stat(filename); err == nil {
+			files = append(files, fmt.Sprintf("%s:%d:%d", filename, info.Size(), info.ModTime().UnixNano()))
+		} else {
+			files = append(files, filename+":missing")
+		}
+	}
+
+	return strings.Join(files, "\n"), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// jsonSchema is a JSON Schema (draft-07) object
+type jsonSchema map[string]interface{}
+
+// schemaID is the URL of the published schema, policy.schema.json
+const schemaID = "https://raw.githubusercontent.com/jumoel/bitbucket-enforcer/master/policy.schema.json"
+
+/*
+Descriptions and value constraints that can't be derived from the types, by
+JSON path. Like in validation errors, "[]" is an entry of a list and "*" is a
+value in an object with arbitrary keys.
+*/
+var schemaDetails = map[string]jsonSchema{
+	"extends":      {"description": "Policies whose settings are included, applied in order"},
+	"private":      {"description": "Whether the repository is private"},
+	"forks":        {"description": "Who may fork the repository", "enum": validForks},
+	"issuetracker": {"description": "Whether the repository has an issue tracker"},
+	"deploykeys":   {"description": "Deploy keys that must be present"},
+	"deploykeys[].name": {
+		"description": "The label of the key",
+		"minLength":   1,
+	},
+	"deploykeys[].key": {
+		"description": "An OpenSSH public key, e.g. 'ssh-ed25519 AAAA... comment'",
+		"pattern":     sshKeyPattern(),
+	},
+	"posthooks": {"description": "URLs that receive a POST on every push"},
+	"posthooks[]": {
+		"pattern": "^(https?://|.*" + referenceSchemaPattern + ")",
+	},
+	"branchmanagement":                 {"description": "Branch restrictions, by branch name or glob pattern"},
+	"branchmanagement.preventdelete":   {"description": "Branches that can't be deleted"},
+	"branchmanagement.preventrebase":   {"description": "Branches that can't be force pushed to"},
+	"branchmanagement.allowpushes":     {"description": "Branches that only the given users and groups may push to"},
+	"branchmanagement.allowpushes.*":   {"description": "The users and groups that may push"},
+	"branchmanagement.preventdelete[]": {"minLength": 1},
+	"branchmanagement.preventrebase[]": {"minLength": 1},
+	"accessmanagement.users":           {"description": "Privileges of users, by Atlassian account ID"},
+	"accessmanagement.users.*":         {"enum": validPrivileges},
+	"accessmanagement.groups":          {"description": "Privileges of groups, by group slug"},
+	"accessmanagement.groups.*":        {"enum": validPrivileges},
+	"prune":                            {"description": "Remove settings that aren't in the policy"},
+	"keep":                             {"description": "Settings that are kept when pruning"},
+	"keep.deploykeys":                  {"description": "Labels of deploy keys"},
+	"keep.posthooks":                   {"description": "URLs of hooks"},
+	"keep.branches":                    {"description": "Branch patterns"},
+	"keep.users":                       {"description": "Atlassian account IDs of users"},
+	"keep.groups":                      {"description": "Group slugs"},
+}
+
+// referenceSchemaPattern matches values with ${env:...} or ${file:...}
+// references, which are only checked once they are resolved
+const referenceSchemaPattern = `\$\{(env|file):[^}]*\}`
+
+func sshKeyPattern() string {
+	keyTypes := make([]string, len(sshKeyTypes))
+	for i, keyType := range sshKeyTypes {
+		keyTypes[i] = regexp.QuoteMeta(keyType)
+	}
+
+	return fmt.Sprintf("^((%s) [A-Za-z0-9+/]+=*( .*)?|.*%s.*)$", strings.Join(keyTypes, "|"), referenceSchemaPattern)
+}
+
+// policySchema returns the JSON Schema of policy files
+func policySchema() jsonSchema {
+	schema := schemaFor(reflect.TypeOf(repositorySettings{}), "")
+
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = schemaID
+	schema["title"] = "bitbucket-enforcer policy"
+
+	// Lets editors find the schema, and is ignored otherwise
+	schema["properties"].(jsonSchema)["$schema"] = jsonSchema{"type": "string"}
+
+	return schema
+}
+
+// schemaFor derives the schema of a type. Properties are named like the
+// settings in the documentation, in lower case.
+func schemaFor(t reflect.Type, jsonPath string) jsonSchema {
+	var schema jsonSchema
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), jsonPath)
+
+	case reflect.Struct:
+		properties := jsonSchema{}
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name := strings.ToLower(field.Name)
+			if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = strings.ToLower(tag)
+			}
+
+			properties[name] = schemaFor(field.Type, joinPath(jsonPath, name))
+		}
+
+		schema = jsonSchema{"type": "object", "properties": properties, "additionalProperties": false}
+
+	case reflect.Map:
+		schema = jsonSchema{"type": "object", "additionalProperties": schemaFor(t.Elem(), joinPath(jsonPath, "*"))}
+
+	case reflect.Slice:
+		schema = jsonSchema{"type": "array", "items": schemaFor(t.Elem(), jsonPath+"[]")}
+
+	case reflect.String:
+		schema = jsonSchema{"type": "string"}
+
+	case reflect.Bool:
+		schema = jsonSchema{"type": "boolean"}
+
+	default:
+		schema = jsonSchema{}
+	}
+
+	for key, value := range schemaDetails[jsonPath] {
+		schema[key] = value
+	}
+
+	return schema
+}
+
+// runSchema implements the 'schema [-out file]' command, which prints the
+// JSON Schema of policy files
+func runSchema(args []string) error {
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	out := flags.String("out", "", "write the schema to this file instead of standard output")
+	parseCommand(flags, args)
+
+	rawSchema, err := json.MarshalIndent(policySchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	rawSchema = append(rawSchema, '\n')
+
+	if *out == "" {
+		_, err = os.Stdout.Write(rawSchema)
+		return err
+	}
+
+	return ioutil.WriteFile(*out, rawSchema, 0644)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+// selectorRule selects a policy for the repositories that match all of its
+// conditions. Conditions that are left out match every repository.
+type selectorRule struct {
+	Policy    string
+	Project   string // project key
+	Name      string // glob, e.g. "*-service"
+	NameRegex string // regular expression, e.g. "^lib-"
+	Language  string
+	Private   *bool
+	Creator   string // username, only known from webhook events
+
+	nameRegex *regexp.Regexp
+}
+
+// policySelector picks the policy of a repository from ordered rules
+type policySelector struct {
+	Rules    []selectorRule
+	Fallback string
+}
+
+// selector is loaded from -selectors. Without it, policies are only selected
+// by description tags.
+var selector *policySelector
+
+/*
+Reads and checks a selector file. Unknown keys and rules without conditions are
+errors, as a rule with a misspelled condition would otherwise match every
+repository.
+*/
+func loadSelector(filename string) (*policySelector, error) {
+	rawSelector, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var s policySelector
+	decoder := json.NewDecoder(bytes.NewReader(rawSelector))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("Error reading selectors '%s': %s", filename, err)
+	}
+
+	if s.Fallback == "" {
+		return nil, fmt.Errorf("Error reading selectors '%s': a fallback policy is required", filename)
+	}
+
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+
+		if rule.Policy == "" {
+			return nil, fmt.Errorf("Error reading selectors '%s': rule %d has no policy", filename, i+1)
+		}
+
+		if !rule.hasConditions() {
+			return nil, fmt.Errorf("Error reading selectors '%s': rule %d has no conditions, use the fallback to select a policy for every repository", filename, i+1)
+		}
+
+		if _, err := path.Match(rule.Name, ""); err != nil {
+			return nil, fmt.Errorf("Error reading selectors '%s': rule %d has an invalid name pattern '%s'", filename, i+1, rule.Name)
+		}
+
+		if rule.NameRegex != "" {
+			if rule.nameRegex, err = regexp.Compile(rule.NameRegex); err != nil {
+				return nil, fmt.Errorf("Error reading selectors '%s': rule %d has an invalid name regex (%s)", filename, i+1, err)
+			}
+		}
+	}
+
+	return &s, nil
+}
+
+// repositoryName returns the slug of a repository
+func repositoryName(repo gobucket.Repository) string {
+	if i := strings.Index(repo.FullName, "/"); i >= 0 {
+		return repo.FullName[i+1:]
+	}
+
+	return repo.Name
+}
+
+// repositoryCreator returns the creator of a repository, which is only known
+// if a 'repo:created' event was received for it, now or before
+func repositoryCreator(repo gobucket.Repository) string {
+	if repo.Creator != "" || state == nil {
+		return repo.Creator
+	}
+
+	record, _ := state.get(repo.FullName)
+
+	return record.Creator
+}
+
+func (r selectorRule) hasConditions() bool {
+	return r.Project != "" || r.Name != "" || r.NameRegex != "" || r.Language != "" || r.Private != nil || r.Creator != ""
+}
+
+func (r selectorRule) matches(repo gobucket.Repository) bool {
+	name := repositoryName(repo)
+
+	if r.Project != "" && !strings.EqualFold(r.Project, repo.Project.Key) {
+		return false
+	}
+
+	if r.Name != "" {
+		if match, _ := path.Match(r.Name, name); !match {
+			return false
+		}
+	}
+
+	if r.nameRegex != nil && !r.nameRegex.MatchString(name) {
+		return false
+	}
+
+	if r.Language != "" && !strings.EqualFold(r.Language, repo.Language) {
+		return false
+	}
+
+	if r.Private != nil && *r.Private != repo.IsPrivate {
+		return false
+	}
+
+	if r.Creator != "" && r.Creator != repositoryCreator(repo) {
+		return false
+	}
+
+	return true
+}
+
+// policy returns the policy of the first rule that matches, or the fallback
+func (s *policySelector) policy(repo gobucket.Repository) string {
+	for _, rule := range s.Rules {
+		if rule.matches(repo) {
+			return rule.Policy
+		}
+	}
+
+	return s.Fallback
+}
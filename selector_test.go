@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+func writeSelector(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "selectors.json")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+func TestSelectorConditions(t *testing.T) {
+	s, err := loadSelector("selectors.json.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old *policySelector) { selector = old }(selector)
+	selector = s
+
+	tests := []struct {
+		name     string
+		repo     gobucket.Repository
+		expected string
+	}{
+		{"project", gobucket.Repository{FullName: "acme/web", Project: gobucket.Project{Key: "java"}}, "java"},
+		{"name and private", gobucket.Repository{FullName: "acme/billing-service", IsPrivate: true}, "service"},
+		{"name but not private", gobucket.Repository{FullName: "acme/billing-service", Language: "rust", IsPrivate: false}, "default"},
+		{"name regex", gobucket.Repository{FullName: "acme/pkg-strings"}, "library"},
+		{"language and private", gobucket.Repository{FullName: "acme/tool", Language: "Go"}, "open-source"},
+		{"creator", gobucket.Repository{FullName: "acme/release", Creator: "release-bot", IsPrivate: true}, "strict"},
+		{"first match", gobucket.Repository{FullName: "acme/lib-service", Project: gobucket.Project{Key: "JAVA"}, IsPrivate: true}, "java"},
+		{"fallback", gobucket.Repository{FullName: "acme/other", Language: "go", IsPrivate: true}, "default"},
+		{"description tag", gobucket.Repository{FullName: "acme/lib-x", Description: "-enforce=tagged", Project: gobucket.Project{Key: "JAVA"}}, "tagged"},
+	}
+
+	for _, test := range tests {
+		if policy := repositoryPolicy(test.repo); policy != test.expected {
+			t.Errorf("%s: expected policy '%s', got '%s'", test.name, test.expected, policy)
+		}
+	}
+}
+
+func TestSelectorRemembersCreator(t *testing.T) {
+	s, err := loadSelector(writeSelector(t, `{"rules": [{"creator": "release-bot", "policy": "strict"}], "fallback": "default"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(old *policySelector, oldState *stateStore) { selector, state = old, oldState }(selector, state)
+	selector = s
+	if state, err = openStateStore(filepath.Join(t.TempDir(), "state.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	state.record("acme/release", enforcementRecord{Result: "enforced", Creator: "release-bot"})
+
+	if policy := repositoryPolicy(gobucket.Repository{FullName: "acme/release"}); policy != "strict" {
+		t.Errorf("expected the recorded creator to select 'strict', got '%s'", policy)
+	}
+}
+
+func TestLoadSelectorErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"rules": [{"projet": "JAVA", "policy": "java"}], "fallback": "default"}`, `unknown field "projet"`},
+		{`{"rules": [{"policy": "java"}], "fallback": "default"}`, "rule 1 has no conditions"},
+		{`{"rules": [{"project": "JAVA", "policy": ""}], "fallback": "default"}`, "rule 1 has no policy"},
+		{`{"rules": [{"nameregex": "(", "policy": "x"}], "fallback": "default"}`, "rule 1 has an invalid name regex"},
+		{`{"rules": [{"name": "[", "policy": "x"}], "fallback": "default"}`, "rule 1 has an invalid name pattern"},
+		{`{"rules": []}`, "a fallback policy is required"},
+	}
+
+	for _, test := range tests {
+		_, err := loadSelector(writeSelector(t, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.content, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+// enforcementRecord is the result of the latest enforcement on a repository
+type enforcementRecord struct {
+	Policy     string    `json:"policy"`
+	PolicyHash string    `json:"policyhash"`
+	Commit     string    `json:"commit,omitempty"` // of the config repository, with -configrepo
+	Time       time.Time `json:"time"`
+	Result     string    `json:"result"` // "enforced" or "failed"
+	Error      string    `json:"error,omitempty"`
+	Creator    string    `json:"creator,omitempty"` // from the 'repo:created' webhook event
+}
+
+func (r enforcementRecord) succeeded() bool {
+	return r.Result == "enforced"
+}
+
+// stateStore keeps an enforcementRecord per repository in a JSON file. It is
+// safe for concurrent use.
+type stateStore struct {
+	path         string
+	mu           sync.Mutex
+	Repositories map[string]enforcementRecord `json:"repositories"`
+}
+
+// openStateStore loads the state in path. A missing file is an empty state.
+func openStateStore(path string) (*stateStore, error) {
+	store := &stateStore{path: path, Repositories: make(map[string]enforcementRecord)}
+
+	rawState, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(rawState, store); err != nil {
+		return nil, fmt.Errorf("Error reading state file '%s': %s", path, err)
+	}
+
+	if store.Repositories == nil {
+		store.Repositories = make(map[string]enforcementRecord)
+	}
+
+	return store, nil
+}
+
+func (s *stateStore) get(fullName string) (enforcementRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.Repositories[fullName]
+	return record, ok
+}
+
+// record stores the record for a repository and writes the state file. The
+// file is replaced atomically, so a crash never leaves a partial file. A known
+// creator is kept.
+func (s *stateStore) record(fullName string, record enforcementRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record.Creator == "" {
+		record.Creator = s.Repositories[fullName].Creator
+	}
+
+	s.Repositories[fullName] = record
+
+	rawState, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(rawState); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// policyHash identifies the content of a policy, independent of formatting
+func policyHash(policy repositorySettings) string {
+	rawPolicy, _ := json.Marshal(policy)
+	sum := sha256.Sum256(rawPolicy)
+
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Reports whether a policy has been enforced on the repository, according to the
+state store or the description. '-enforced' in the description is honoured even
+without -descriptiontag, as earlier versions marked every enforced repository
+that way and kept no state file.
+*/
+func isEnforced(repo gobucket.Repository) bool {
+	if strings.Contains(repo.Description, "-enforced") {
+		return true
+	}
+
+	record, ok := state.get(repo.FullName)
+
+	return ok && record.succeeded()
+}
+
+/*
+Reports whether the policy of an enforced repository has changed since it was
+enforced, either because another policy is requested or because the content of
+the policy has changed. Repositories that are only marked with '-enforced' in
+the description have no recorded policy and are never considered changed.
+*/
+func policyChanged(repo gobucket.Repository, policyname string) bool {
+	record, ok := state.get(repo.FullName)
+	if !ok {
+		return false
+	}
+
+	if record.Policy != policyname {
+		return true
+	}
+
+	policy, err := repositoryPolicySettings(repo, policyname)
+	if err != nil {
+		// Enforcing would fail as well, so keep the repository as it is
+		return false
+	}
+
+	return record.PolicyHash != policyHash(policy)
+}
+
+/*
+Records the outcome of enforcing a policy on a repository in the state store.
+With -descriptiontag, '-enforced' is also added to the description of
+repositories that were enforced successfully.
+*/
+func recordEnforcement(ctx context.Context, repo gobucket.Repository, policyname string, policy repositorySettings, enforceErr error) {
+	recordState(repo.FullName, repo.Creator, policyname, policyHash(policy), policyCommit(policyname), enforceErr)
+
+	if enforceErr == nil && *descriptionTag && !strings.Contains(repo.Description, "-enforced") {
+		parts := strings.Split(repo.FullName, "/")
+		newDescription := strings.TrimSpace(fmt.Sprintf("%s\n\n-enforced", repo.Description))
+
+		if err := bbAPI.SetDescription(ctx, parts[0], parts[1], newDescription); err != nil {
+			log.Warning(fmt.Sprintf("Could not set description on repo '%s' (%s)", repo.FullName, err))
+		}
+	}
+}
+
+// recordState stores an enforcementRecord, unless this is a dry run. The
+// creator and commit may be empty if they aren't known.
+func recordState(fullName string, creator string, policyname string, hash string, commit string, enforceErr error) {
+	if *dryRun {
+		return
+	}
+
+	record := enforcementRecord{
+		Policy:     policyname,
+		PolicyHash: hash,
+		Commit:     commit,
+		Time:       time.Now().UTC(),
+		Result:     "enforced",
+		Creator:    creator,
+	}
+
+	if enforceErr != nil {
+		record.Result = "failed"
+		record.Error = enforceErr.Error()
+	}
+
+	if err := state.record(fullName, record); err != nil {
+		log.Error(fmt.Sprintf("Could not record state of repo '%s' (%s)", fullName, err))
+	}
+}
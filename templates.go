@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+/*
+templateData is available to the Go templates in policy values, e.g.
+'https://ci.example.com/hooks/{{.Repo}}' or '{{.Project}}-maintainers'. Labels
+are read from the repository description, where '-team=payments' is the label
+'team' with the value 'payments', and '-noenforce' is the label 'noenforce'
+without a value.
+*/
+type templateData struct {
+	Owner   string
+	Repo    string // the slug
+	Project string // the project key
+	Labels  map[string]string
+}
+
+var labelMatcher = regexp.MustCompile(`(?:^|\s)-([a-zA-Z][a-zA-Z0-9_.]*)(?:=(\S*))?`)
+
+func repositoryTemplateData(repo gobucket.Repository) templateData {
+	data := templateData{
+		Owner:   strings.SplitN(repo.FullName, "/", 2)[0],
+		Repo:    repositoryName(repo),
+		Project: repo.Project.Key,
+		Labels:  make(map[string]string),
+	}
+
+	for _, match := range labelMatcher.FindAllStringSubmatch(repo.Description, -1) {
+		data.Labels[match[1]] = match[2]
+	}
+
+	return data
+}
+
+// sampleTemplateData is used to check the templates in a policy before it is
+// enforced on a repository. Every label used by a template is "label".
+var sampleTemplateData = templateData{Owner: "owner", Repo: "repo", Project: "PROJECT"}
+
+/*
+Expands the templates in the values of a policy, and in the names of users,
+groups and branches, for a repository. Templates are only parsed in strings
+that contain '{{'. Labels that the repository doesn't have are errors. If
+data has no labels, as sampleTemplateData, every label that is used is
+"label".
+*/
+func expandTemplates(source string, policy repositorySettings, data templateData) (repositorySettings, validationErrors) {
+	rawPolicy, _ := json.Marshal(policy)
+	if !bytes.Contains(rawPolicy, []byte("{{")) {
+		return policy, nil
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(rawPolicy, &generic); err != nil {
+		return policy, validationErrors{{source, "", err.Error()}}
+	}
+
+	var errs validationErrors
+	expand := func(jsonPath string, text string) string {
+		if !strings.Contains(text, "{{") {
+			return text
+		}
+
+		tmpl, err := template.New("value").Option("missingkey=error").Parse(text)
+		if err != nil {
+			errs = append(errs, validationError{source, jsonPath, fmt.Sprintf("invalid template (%s)", err)})
+			return text
+		}
+
+		tmplData := data
+		if data.Labels == nil {
+			tmplData.Labels = make(map[string]string)
+			for _, label := range templateLabels(tmpl.Tree.Root) {
+				tmplData.Labels[label] = "label"
+			}
+		}
+
+		var expanded strings.Builder
+		if err := tmpl.Execute(&expanded, tmplData); err != nil {
+			errs = append(errs, validationError{source, jsonPath, fmt.Sprintf("can't expand template (%s)", err)})
+			return text
+		}
+
+		return expanded.String()
+	}
+
+	generic = expandValue("", generic, reflect.TypeOf(repositorySettings{}), expand)
+	if len(errs) > 0 {
+		return policy, errs
+	}
+
+	rawPolicy, _ = json.Marshal(generic)
+
+	var expanded repositorySettings
+	if err := json.Unmarshal(rawPolicy, &expanded); err != nil {
+		return policy, validationErrors{{source, "", err.Error()}}
+	}
+
+	return expanded, nil
+}
+
+// expandValue expands the strings in a value decoded from JSON, and the keys of
+// objects that are maps in t, such as user names
+func expandValue(jsonPath string, value interface{}, t reflect.Type, expand func(string, string) string) interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for _, key := range sortedObjectKeys(value) {
+			if t.Kind() == reflect.Map {
+				keyPath := joinPath(jsonPath, key)
+				object[expand(keyPath, key)] = expandValue(keyPath, value[key], t.Elem(), expand)
+			} else if field, ok := jsonField(t, key); ok {
+				object[key] = expandValue(joinPath(jsonPath, strings.ToLower(key)), value[key], field.Type, expand)
+			}
+		}
+
+		return object
+
+	case []interface{}:
+		for i, entry := range value {
+			value[i] = expandValue(fmt.Sprintf("%s[%d]", jsonPath, i), entry, t.Elem(), expand)
+		}
+
+	case string:
+		return expand(jsonPath, value)
+	}
+
+	return value
+}
+
+// templateLabels returns the labels a template uses as '.Labels.name'
+func templateLabels(node parse.Node) []string {
+	var labels []string
+
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node != nil {
+			for _, child := range node.Nodes {
+				labels = append(labels, templateLabels(child)...)
+			}
+		}
+
+	case *parse.ActionNode:
+		labels = templateLabels(node.Pipe)
+
+	case *parse.PipeNode:
+		if node != nil {
+			for _, cmd := range node.Cmds {
+				labels = append(labels, templateLabels(cmd)...)
+			}
+		}
+
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			labels = append(labels, templateLabels(arg)...)
+		}
+
+	case *parse.FieldNode:
+		if len(node.Ident) > 1 && node.Ident[0] == "Labels" {
+			labels = append(labels, node.Ident[1])
+		}
+
+	case *parse.IfNode:
+		labels = append(templateLabels(node.Pipe), append(templateLabels(node.List), templateLabels(node.ElseList)...)...)
+
+	case *parse.WithNode:
+		labels = append(templateLabels(node.Pipe), append(templateLabels(node.List), templateLabels(node.ElseList)...)...)
+
+	case *parse.RangeNode:
+		labels = append(templateLabels(node.Pipe), append(templateLabels(node.List), templateLabels(node.ElseList)...)...)
+	}
+
+	return labels
+}
+
+/*
+Reads a policy and expands its templates for a repository. The expanded policy
+is checked again, as the values of a repository can make it invalid, e.g. a
+label containing a space in a branch name.
+*/
+func repositoryPolicySettings(repo gobucket.Repository, policyname string) (repositorySettings, error) {
+	policy, err := parseConfig(policyname)
+	if err != nil {
+		return repositorySettings{}, err
+	}
+
+	source := fmt.Sprintf("policy '%s' for repo '%s'", policyname, repo.FullName)
+
+	policy, errs := expandTemplates(source, policy, repositoryTemplateData(repo))
+	if len(errs) > 0 {
+		return repositorySettings{}, errs
+	}
+
+	if errs := checkPolicyValues(source, policy); len(errs) > 0 {
+		return repositorySettings{}, errs
+	}
+
+	return policy, nil
+}
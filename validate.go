@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// validationError is a single problem in a policy file
+type validationError struct {
+	File   string
+	Path   string // e.g. "branchmanagement.allowpushes.master.users[0]"
+	Reason string
+}
+
+// Error hides the values resolved from references, as the reason often
+// contains the value
+func (e validationError) Error() string {
+	if e.Path == "" {
+		return redact(fmt.Sprintf("%s: %s", e.File, e.Reason))
+	}
+
+	return redact(fmt.Sprintf("%s: %s: %s", e.File, e.Path, e.Reason))
+}
+
+// validationErrors are all the problems found in a policy file
+type validationErrors []validationError
+
+func (errs validationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+var validPrivileges = []string{"read", "write", "admin"}
+var validForks = []string{"none", "private", "public"}
+
+// sshKeyTypes are the deploy key types accepted by Bitbucket
+var sshKeyTypes = []string{
+	"ssh-rsa",
+	"ssh-dss",
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"sk-ssh-ed25519@openssh.com",
+	"sk-ecdsa-sha2-nistp256@openssh.com",
+}
+
+/*
+Checks a policy file and returns every problem in it. The JSON is checked
+against repositorySettings first, which finds unknown settings and values of
+the wrong type. If that succeeds, the values are checked: fork policies,
+privileges, SSH keys, hook URLs, branch patterns, templates and extended
+policies.
+*/
+func validatePolicy(filename string, rawConfig []byte) validationErrors {
+	var generic interface{}
+	if err := json.Unmarshal(rawConfig, &generic); err != nil {
+		return validationErrors{{filename, "", describeJSONError(rawConfig, err)}}
+	}
+
+	errs := checkJSONType(filename, "", generic, reflect.TypeOf(repositorySettings{}))
+	if len(errs) > 0 {
+		return errs
+	}
+
+	var policy repositorySettings
+	if err := json.Unmarshal(rawConfig, &policy); err != nil {
+		return validationErrors{{filename, "", err.Error()}}
+	}
+
+	// The values of templates are only known per repository, so they are
+	// checked with sample values here, and again when they are expanded
+	expanded, errs := expandTemplates(filename, policy, sampleTemplateData)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return checkPolicyValues(filename, expanded)
+}
+
+// describeJSONError adds the line and column to JSON syntax errors
+func describeJSONError(raw []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return err.Error()
+	}
+
+	// The offset is just after the character that caused the error
+	offset := syntaxErr.Offset
+	if offset > 0 {
+		offset--
+	}
+
+	before := raw[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+
+	return fmt.Sprintf("line %d, column %d: %s", line, column, err)
+}
+
+// jsonField finds the struct field a JSON key is decoded into. Like
+// encoding/json, the key is matched case-insensitively.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+func joinPath(parent string, key string) string {
+	if parent == "" {
+		return key
+	}
+
+	return parent + "." + key
+}
+
+// checkJSONType checks that a decoded JSON value matches the Go type it will
+// be decoded into, and that objects only contain known settings
+func checkJSONType(filename string, jsonPath string, value interface{}, t reflect.Type) validationErrors {
+	if t.Kind() == reflect.Ptr {
+		if value == nil {
+			return nil
+		}
+		t = t.Elem()
+	}
+
+	wrongType := func(expected string) validationErrors {
+		return validationErrors{{filename, jsonPath, fmt.Sprintf("must be %s", expected)}}
+	}
+
+	var errs validationErrors
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return wrongType("an object")
+		}
+
+		for _, key := range sortedObjectKeys(object) {
+			// Points editors to the JSON Schema of policies
+			if jsonPath == "" && key == "$schema" {
+				continue
+			}
+
+			field, ok := jsonField(t, key)
+			if !ok {
+				errs = append(errs, validationError{filename, joinPath(jsonPath, key), "unknown setting"})
+				continue
+			}
+
+			errs = append(errs, checkJSONType(filename, joinPath(jsonPath, key), object[key], field.Type)...)
+		}
+
+	case reflect.Map:
+		if value == nil {
+			return nil
+		}
+
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return wrongType("an object")
+		}
+
+		for _, key := range sortedObjectKeys(object) {
+			errs = append(errs, checkJSONType(filename, joinPath(jsonPath, key), object[key], t.Elem())...)
+		}
+
+	case reflect.Slice:
+		if value == nil {
+			return nil
+		}
+
+		list, ok := value.([]interface{})
+		if !ok {
+			return wrongType("a list")
+		}
+
+		for i, entry := range list {
+			errs = append(errs, checkJSONType(filename, fmt.Sprintf("%s[%d]", jsonPath, i), entry, t.Elem())...)
+		}
+
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			return wrongType("a string")
+		}
+
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			return wrongType("true or false")
+		}
+	}
+
+	return errs
+}
+
+func sortedObjectKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// checkPolicyValues checks the values of a policy that has the right shape
+func checkPolicyValues(filename string, policy repositorySettings) validationErrors {
+	var errs validationErrors
+
+	fail := func(jsonPath string, format string, args ...interface{}) {
+		errs = append(errs, validationError{filename, jsonPath, fmt.Sprintf(format, args...)})
+	}
+
+	for i, parent := range policy.Extends {
+		if !policyExists(parent) {
+			fail(fmt.Sprintf("extends[%d]", i), "policy '%s' doesn't exist", parent)
+		}
+	}
+
+	if policy.Forks != "" && !contains(validForks, policy.Forks) {
+		fail("forks", "must be one of %s, not '%s'", strings.Join(validForks, ", "), policy.Forks)
+	}
+
+	names := make(map[string]bool)
+	for i, key := range policy.DeployKeys {
+		keyPath := fmt.Sprintf("deploykeys[%d]", i)
+
+		if key.Name == "" {
+			fail(keyPath+".name", "is required")
+		} else if names[key.Name] {
+			fail(keyPath+".name", "'%s' is used by another key", key.Name)
+		}
+		names[key.Name] = true
+
+		if err := checkSSHKey(key.Key); err != nil {
+			fail(keyPath+".key", "%s", err)
+		}
+	}
+
+	for i, hook := range policy.PostHooks {
+		if err := checkHookURL(hook); err != nil {
+			fail(fmt.Sprintf("posthooks[%d]", i), "%s", err)
+		}
+	}
+
+	for i, branch := range policy.BranchManagement.PreventDelete {
+		if err := checkBranchPattern(branch); err != nil {
+			fail(fmt.Sprintf("branchmanagement.preventdelete[%d]", i), "%s", err)
+		}
+	}
+
+	for i, branch := range policy.BranchManagement.PreventRebase {
+		if err := checkBranchPattern(branch); err != nil {
+			fail(fmt.Sprintf("branchmanagement.preventrebase[%d]", i), "%s", err)
+		}
+	}
+
+	for _, branch := range sortedPushBranches(policy.BranchManagement.AllowPushes) {
+		branchPath := joinPath("branchmanagement.allowpushes", branch)
+		permissions := policy.BranchManagement.AllowPushes[branch]
+
+		if err := checkBranchPattern(branch); err != nil {
+			fail(branchPath, "%s", err)
+		}
+
+		for i, user := range permissions.Users {
+			if user == "" {
+				fail(fmt.Sprintf("%s.users[%d]", branchPath, i), "must not be empty")
+			}
+		}
+
+		for i, group := range permissions.Groups {
+			if group == "" {
+				fail(fmt.Sprintf("%s.groups[%d]", branchPath, i), "must not be empty")
+			}
+		}
+	}
+
+	for _, user := range sortedKeys(policy.AccessManagement.Users) {
+		if privilege := policy.AccessManagement.Users[user]; !contains(validPrivileges, privilege) {
+			fail(joinPath("accessmanagement.users", user), "must be one of %s, not '%s'", strings.Join(validPrivileges, ", "), privilege)
+		}
+	}
+
+	for _, group := range sortedKeys(policy.AccessManagement.Groups) {
+		if privilege := policy.AccessManagement.Groups[group]; !contains(validPrivileges, privilege) {
+			fail(joinPath("accessmanagement.groups", group), "must be one of %s, not '%s'", strings.Join(validPrivileges, ", "), privilege)
+		}
+	}
+
+	return errs
+}
+
+func sortedPushBranches(pushes map[string]pushPermissions) []string {
+	branches := make([]string, 0, len(pushes))
+	for branch := range pushes {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+
+	return branches
+}
+
+/*
+Checks that a key is an OpenSSH public key: a known key type, followed by the
+base64 encoded key, optionally followed by a comment. The encoded key must
+start with the same key type.
+*/
+func checkSSHKey(key string) error {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return errors.New("must be an SSH public key like 'ssh-ed25519 AAAA... comment'")
+	}
+
+	if !contains(sshKeyTypes, fields[0]) {
+		return fmt.Errorf("unknown SSH key type '%s'", fields[0])
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return errors.New("the SSH key isn't valid base64")
+	}
+
+	if len(blob) < 4 {
+		return errors.New("the SSH key is too short")
+	}
+
+	length := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)) < 4+uint64(length) || string(blob[4:4+length]) != fields[0] {
+		return fmt.Errorf("the SSH key doesn't contain a '%s' key", fields[0])
+	}
+
+	return nil
+}
+
+func checkHookURL(hook string) error {
+	u, err := url.Parse(hook)
+	if err != nil {
+		return fmt.Errorf("invalid URL (%s)", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("'%s' must be an http or https URL", hook)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("'%s' has no host", hook)
+	}
+
+	return nil
+}
+
+// checkBranchPattern checks a branch name or glob pattern like "release/*"
+func checkBranchPattern(pattern string) error {
+	if strings.TrimSpace(pattern) == "" {
+		return errors.New("the branch pattern must not be empty")
+	}
+
+	if strings.ContainsAny(pattern, " \t\n~^:\\") {
+		return fmt.Errorf("'%s' contains characters that aren't allowed in branch names", pattern)
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("'%s' is not a valid pattern", pattern)
+	}
+
+	return nil
+}
+
+/*
+Implements the 'validate [policy...]' command. It checks the given policies, or
+every policy in -configdir, and the -selectors file. Every problem is printed,
+and the command fails if there are any.
+*/
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	policynames := parseCommand(flags, args)
+
+	if len(policynames) == 0 {
+		var err error
+		if policynames, err = policyNames(); err != nil {
+			return err
+		}
+	}
+
+	var problems int
+
+	// Files whose problems have been printed
+	reported := make(map[string]bool)
+
+	var valid []string
+	for _, policyname := range policynames {
+		if _, err := readPolicy(policyname); err != nil {
+			problems += reportValidation(err)
+			markReported(reported, err)
+			continue
+		}
+
+		valid = append(valid, policyname)
+	}
+
+	// A valid policy can't be loaded either if a policy it extends has problems
+	for _, policyname := range valid {
+		_, err := resolvePolicy(policyname, nil)
+		if err == nil {
+			fmt.Printf("%s: ok\n", policyFile(policyname))
+			continue
+		}
+
+		var errs validationErrors
+		if !errors.As(err, &errs) {
+			fmt.Printf("%s: %s\n", policyFile(policyname), err)
+			problems++
+			continue
+		}
+
+		fmt.Printf("%s: extends a policy with problems\n", policyFile(policyname))
+		problems++
+
+		if !errs.reportedIn(reported) {
+			problems += reportValidation(errs)
+			markReported(reported, errs)
+		}
+	}
+
+	if selector != nil {
+		for i, rule := range selector.Rules {
+			if !policyExists(rule.Policy) {
+				fmt.Printf("%s: rules[%d].policy: policy '%s' doesn't exist\n", *selectorFile, i, rule.Policy)
+				problems++
+			}
+		}
+
+		if !policyExists(selector.Fallback) {
+			fmt.Printf("%s: fallback: policy '%s' doesn't exist\n", *selectorFile, selector.Fallback)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("Found %d problems in the policies", problems)
+	}
+
+	return nil
+}
+
+func markReported(reported map[string]bool, err error) {
+	var errs validationErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			reported[e.File] = true
+		}
+	}
+}
+
+func (errs validationErrors) reportedIn(reported map[string]bool) bool {
+	for _, e := range errs {
+		if !reported[e.File] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reportValidation prints the problems in err and returns their number
+func reportValidation(err error) int {
+	var errs validationErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			fmt.Println(e)
+		}
+
+		return len(errs)
+	}
+
+	fmt.Println(err)
+
+	return 1
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSSHKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f ci@example.com"
+
+func TestCheckJSONType(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected []string
+	}{
+		{map[string]interface{}{"$schema": "policy.schema.json", "Private": true, "forks": "none"}, nil},
+		{map[string]interface{}{"mainbranch": "master"}, []string{"p.json: mainbranch: unknown setting"}},
+		{map[string]interface{}{"private": "yes"}, []string{"p.json: private: must be true or false"}},
+		{map[string]interface{}{"forks": false}, []string{"p.json: forks: must be a string"}},
+		{map[string]interface{}{"posthooks": "https://ci.example.com"}, []string{"p.json: posthooks: must be a list"}},
+		{[]interface{}{}, []string{"p.json: must be an object"}},
+		{
+			map[string]interface{}{"deploykeys": []interface{}{
+				map[string]interface{}{"name": "ci", "key": testSSHKey},
+				map[string]interface{}{"name": "ci", "value": testSSHKey},
+			}},
+			[]string{"p.json: deploykeys[1].value: unknown setting"},
+		},
+		{
+			map[string]interface{}{"branchmanagement": map[string]interface{}{
+				"allowpushes":   map[string]interface{}{"master": map[string]interface{}{"users": []interface{}{1.0}}},
+				"preventdelete": "master",
+			}},
+			[]string{
+				"p.json: branchmanagement.allowpushes.master.users[0]: must be a string",
+				"p.json: branchmanagement.preventdelete: must be a list",
+			},
+		},
+		{
+			map[string]interface{}{"accessmanagement": map[string]interface{}{"groups": map[string]interface{}{"b": "read", "a": true}}},
+			[]string{"p.json: accessmanagement.groups.a: must be a string"},
+		},
+	}
+
+	for _, test := range tests {
+		errs := checkJSONType("p.json", "", test.value, reflect.TypeOf(repositorySettings{}))
+
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+
+		if !reflect.DeepEqual(messages, test.expected) {
+			t.Errorf("%v: expected %q, got %q", test.value, test.expected, messages)
+		}
+	}
+}
+
+func TestCheckSSHKey(t *testing.T) {
+	tests := []struct {
+		key string
+		err string
+	}{
+		{testSSHKey, ""},
+		{strings.Fields(testSSHKey)[0] + " " + strings.Fields(testSSHKey)[1], ""},
+		{"AAAAC3NzaC1lZDI1NTE5", "must be an SSH public key"},
+		{"ssh-foo AAAAC3NzaC1lZDI1NTE5", "unknown SSH key type 'ssh-foo'"},
+		{"ssh-ed25519 not-base64!", "isn't valid base64"},
+		{"ssh-ed25519 AAA=", "too short"},
+		{"ssh-ed25519 AAAAB3NzaC1yc2E=", "doesn't contain a 'ssh-ed25519' key"},
+		{"ssh-ed25519 AAAA/w==", "doesn't contain a 'ssh-ed25519' key"},
+	}
+
+	for _, test := range tests {
+		err := checkSSHKey(test.key)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.key, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.key, test.err, err)
+		}
+	}
+}
+
+func TestCheckHookURL(t *testing.T) {
+	tests := []struct {
+		hook string
+		err  string
+	}{
+		{"https://ci.example.com/hooks/api", ""},
+		{"http://localhost:8080", ""},
+		{"ftp://ci.example.com", "must be an http or https URL"},
+		{"ci.example.com/hooks", "must be an http or https URL"},
+		{"https:///hooks", "has no host"},
+		{"https://ci.example.com/%zz", "invalid URL"},
+	}
+
+	for _, test := range tests {
+		err := checkHookURL(test.hook)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.hook, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error containing '%s', got %v", test.hook, test.err, err)
+		}
+	}
+}
+
+func TestCheckBranchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		err     string
+	}{
+		{"master", ""},
+		{"release/*", ""},
+		{"feature/[a-z]*", ""},
+		{"", "must not be empty"},
+		{"  ", "must not be empty"},
+		{"my branch", "aren't allowed in branch names"},
+		{"HEAD~1", "aren't allowed in branch names"},
+		{"refs:heads", "aren't allowed in branch names"},
+		{"release/[", "is not a valid pattern"},
+	}
+
+	for _, test := range tests {
+		err := checkBranchPattern(test.pattern)
+		if test.err == "" && err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.pattern, err)
+		} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("'%s': expected an error containing '%s', got %v", test.pattern, test.err, err)
+		}
+	}
+}
+
+func TestValidatePolicyErrors(t *testing.T) {
+	useTestServer(t, map[string]string{"default.json": `{}`})
+
+	tests := []struct {
+		policy   string
+		expected string
+	}{
+		{`{"private": false, "extends": ["default"]}`, ""},
+		{"{\n  \"private\": false,\n  \"forks\" \"none\"\n}", "p.json: line 3, column 11: invalid character '\"' after object key"},
+		{`{"mainbranch": "master"}`, "p.json: mainbranch: unknown setting"},
+		{`{"extends": ["missing"]}`, "p.json: extends[0]: policy 'missing' doesn't exist"},
+		{`{"forks": "everyone"}`, "p.json: forks: must be one of none, private, public, not 'everyone'"},
+		{
+			`{"deploykeys": [{"name": "ci", "key": "` + testSSHKey + `"}, {"name": "ci", "key": "ssh-rsa"}]}`,
+			"p.json: deploykeys[1].name: 'ci' is used by another key\n" +
+				"p.json: deploykeys[1].key: must be an SSH public key like 'ssh-ed25519 AAAA... comment'",
+		},
+		{`{"posthooks": ["https://ci.example.com", "ci"]}`, "p.json: posthooks[1]: 'ci' must be an http or https URL"},
+		{
+			`{"branchmanagement": {"preventrebase": ["a b"], "allowpushes": {"master": {"users": [""]}}}}`,
+			"p.json: branchmanagement.preventrebase[0]: 'a b' contains characters that aren't allowed in branch names\n" +
+				"p.json: branchmanagement.allowpushes.master.users[0]: must not be empty",
+		},
+		{
+			`{"accessmanagement": {"users": {"5b10ac8d82e05b22cc7d4ef5": "owner"}}}`,
+			"p.json: accessmanagement.users.5b10ac8d82e05b22cc7d4ef5: must be one of read, write, admin, not 'owner'",
+		},
+	}
+
+	for _, test := range tests {
+		errs := validatePolicy("p.json", []byte(test.policy))
+		if len(errs) == 0 {
+			if test.expected != "" {
+				t.Errorf("%s: expected the error '%s'", test.policy, test.expected)
+			}
+			continue
+		}
+
+		if errs.Error() != test.expected {
+			t.Errorf("%s: expected the error '%s', got '%s'", test.policy, test.expected, errs)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+	"github.com/jumoel/bitbucket-enforcer/log"
+)
+
+// maxWebhookBody limits the size of webhook payloads that are read
+const maxWebhookBody = 1 << 20
+
+// webhookRepositories receives the repositories from webhook events. They are
+// processed by scanRepositories, so they are never enforced concurrently with
+// the polling.
+var webhookRepositories = make(chan gobucket.Repository, 100)
+
+type webhookEvent struct {
+	Actor struct {
+		Nickname string `json:"nickname"`
+	} `json:"actor"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// startWebhookReceiver serves the webhook receiver on /webhook in the
+// background until ctx is cancelled. The secret is required to verify the
+// event signatures.
+func startWebhookReceiver(ctx context.Context, addr string, secret string) error {
+	if secret == "" {
+		return errors.New("BITBUCKET_ENFORCER_WEBHOOK_SECRET must be set to receive webhooks")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", webhookHandler(secret))
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		log.Info(fmt.Sprintf("Receiving webhooks on %s/webhook", addr))
+
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Critical("Webhook receiver stopped", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+
+		server.Shutdown(shutdownCtx)
+	}()
+
+	return nil
+}
+
+// validSignature checks the X-Hub-Signature header, which contains the
+// HMAC-SHA256 of the body using the webhook secret
+func validSignature(signature string, body []byte, secret string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+/*
+Handles workspace webhook events. 'repo:created' and 'repo:updated' events
+queue the repository for enforcement, other events are ignored. The
+repository is fetched from the API, as the payload doesn't contain the full
+description.
+*/
+func webhookHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, "Could not read body", http.StatusBadRequest)
+			return
+		}
+
+		if !validSignature(r.Header.Get("X-Hub-Signature"), body, secret) {
+			log.Warning(fmt.Sprintf("Rejected webhook with invalid signature from %s", r.RemoteAddr))
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		eventKey := r.Header.Get("X-Event-Key")
+		if eventKey != "repo:created" && eventKey != "repo:updated" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil || !strings.Contains(event.Repository.FullName, "/") {
+			http.Error(w, "Invalid payload", http.StatusBadRequest)
+			return
+		}
+
+		parts := strings.SplitN(event.Repository.FullName, "/", 2)
+
+		repo, err := bbAPI.GetRepository(r.Context(), parts[0], parts[1])
+		if gobucket.IsNotFound(err) {
+			// Deleted or renamed since the event was sent
+			if *verbose {
+				log.Info(fmt.Sprintf("Ignoring '%s' event for missing repo '%s'", eventKey, event.Repository.FullName))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else if err != nil {
+			log.Warning(fmt.Sprintf("Could not get repo '%s' from '%s' event (%s)", event.Repository.FullName, eventKey, err))
+			http.Error(w, "Could not get repository", http.StatusBadGateway)
+			return
+		}
+		repo.FullName = event.Repository.FullName
+		if eventKey == "repo:created" {
+			repo.Creator = event.Actor.Nickname
+		}
+
+		select {
+		case webhookRepositories <- repo:
+			if *verbose {
+				log.Info(fmt.Sprintf("Received '%s' event for repo '%s'", eventKey, repo.FullName))
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			// Polling will pick up the repository later
+			log.Warning(fmt.Sprintf("Dropped '%s' event for repo '%s', too many queued events", eventKey, repo.FullName))
+			http.Error(w, "Too many queued events", http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jumoel/bitbucket-enforcer/gobucket"
+)
+
+const testWebhookSecret = "webhook-secret"
+
+func sign(body string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"repository": {"full_name": "acme/api"}}`)
+
+	tests := []struct {
+		signature string
+		valid     bool
+	}{
+		{sign(string(body), testWebhookSecret), true},
+		{sign(string(body), "other-secret"), false},
+		{sign(`{"repository": {"full_name": "acme/web"}}`, testWebhookSecret), false},
+		{strings.TrimPrefix(sign(string(body), testWebhookSecret), "sha256="), false},
+		{"sha1=" + strings.TrimPrefix(sign(string(body), testWebhookSecret), "sha256="), false},
+		{"sha256=not-hex", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if valid := validSignature(test.signature, body, testWebhookSecret); valid != test.valid {
+			t.Errorf("'%s': expected valid to be %v", test.signature, test.valid)
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	server := useTestServer(t, nil)
+	server.Bitbucket.AddRepository("acme", "api", "Payments API")
+
+	defer func(old chan gobucket.Repository) { webhookRepositories = old }(webhookRepositories)
+	webhookRepositories = make(chan gobucket.Repository, 1)
+
+	handler := webhookHandler(testWebhookSecret)
+
+	send := func(method string, eventKey string, body string, signature string) int {
+		r := httptest.NewRequest(method, "/webhook", strings.NewReader(body))
+		r.Header.Set("X-Event-Key", eventKey)
+		if signature != "" {
+			r.Header.Set("X-Hub-Signature", signature)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	created := `{"actor": {"nickname": "release-bot"}, "repository": {"full_name": "acme/api"}}`
+	missing := `{"repository": {"full_name": "acme/missing"}}`
+
+	tests := []struct {
+		name      string
+		method    string
+		eventKey  string
+		body      string
+		signature string
+		status    int
+	}{
+		{"wrong method", "GET", "repo:created", created, sign(created, testWebhookSecret), http.StatusMethodNotAllowed},
+		{"missing signature", "POST", "repo:created", created, "", http.StatusUnauthorized},
+		{"bad signature", "POST", "repo:created", created, sign(created, "other-secret"), http.StatusUnauthorized},
+		{"other event", "POST", "repo:push", created, sign(created, testWebhookSecret), http.StatusNoContent},
+		{"invalid payload", "POST", "repo:created", `{}`, sign(`{}`, testWebhookSecret), http.StatusBadRequest},
+		{"missing repository", "POST", "repo:updated", missing, sign(missing, testWebhookSecret), http.StatusNoContent},
+		{"created", "POST", "repo:created", created, sign(created, testWebhookSecret), http.StatusAccepted},
+		{"full queue", "POST", "repo:updated", created, sign(created, testWebhookSecret), http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		if status := send(test.method, test.eventKey, test.body, test.signature); status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+		}
+	}
+
+	if len(webhookRepositories) != 1 {
+		t.Fatalf("expected one queued repository, got %d", len(webhookRepositories))
+	}
+
+	repo := <-webhookRepositories
+	if repo.FullName != "acme/api" || repo.Description != "Payments API" || repo.Creator != "release-bot" {
+		t.Errorf("unexpected queued repository: %+v", repo)
+	}
+}